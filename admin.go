@@ -0,0 +1,392 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// adminRecord defines JSON view of db record, challenge solutions are never exposed.
+type adminRecord struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Domain    string    `json:"domain"`
+	Address   string    `json:"address,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Issued    time.Time `json:"issued"`
+	Expires   time.Time `json:"expires"`
+}
+
+// adminRecordList defines JSON list of db records.
+type adminRecordList struct {
+	Count   int           `json:"count"`
+	Records []adminRecord `json:"records,omitempty"`
+}
+
+// adminSessionRequest defines JSON request to pre-issue session.
+type adminSessionRequest struct {
+	Domain    string   `json:"domain"`
+	UserAgent string   `json:"user_agent"`
+	Address   string   `json:"address"`
+	TTL       duration `json:"ttl"`
+}
+
+// adminSession defines JSON pre-issued session.
+type adminSession struct {
+	Token      string    `json:"token"`
+	CookieName string    `json:"cookie_name"`
+	Domain     string    `json:"domain"`
+	Expires    time.Time `json:"expires"`
+}
+
+// adminResult defines JSON result of bulk operation.
+type adminResult struct {
+	Count int `json:"count"`
+}
+
+// recordFilter selects db records by domain, client address and UA.
+type recordFilter struct {
+	Domain    string
+	Address   string
+	UserAgent string
+}
+
+// readAdminToken reads admin API bearer token file.
+func readAdminToken(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("admin token error: %w", err)
+	}
+
+	token := []byte(strings.TrimSpace(string(b)))
+	if len(token) < 16 {
+		return nil, fmt.Errorf("admin token error: token must be at least 16 bytes long")
+	}
+
+	return token, nil
+}
+
+// getRecordFilter reads record filter from "domain", "ip" and "ua" query parameters.
+func getRecordFilter(r *http.Request) recordFilter {
+	q := r.URL.Query()
+
+	return recordFilter{
+		Domain:    strings.ToLower(strings.TrimPrefix(q.Get("domain"), ".")),
+		Address:   q.Get("ip"),
+		UserAgent: q.Get("ua"),
+	}
+}
+
+// isEmpty checks that filter selects every record.
+func (f recordFilter) isEmpty() bool {
+	return f.Domain == "" && f.Address == "" && f.UserAgent == ""
+}
+
+// match checks that record is selected by filter, wildcard domain matches its host.
+func (f recordFilter) match(record captchaDBRecord) bool {
+	if f.Domain != "" && !strings.EqualFold(strings.TrimPrefix(record.Domain, "."), f.Domain) {
+		return false
+	}
+
+	if f.Address != "" && record.Address != getRecordAddress(f.Address) {
+		return false
+	}
+
+	if f.UserAgent != "" {
+		// full UA is matched by substring, anonymized UA only by exact value
+		if cmdPrivacyRecords == privacyRecordsFull {
+			return strings.Contains(strings.ToLower(record.UserAgent), strings.ToLower(f.UserAgent))
+		}
+
+		return record.UserAgent == getRecordUserAgent(f.UserAgent)
+	}
+
+	return true
+}
+
+// listRecords returns active db records of specified types selected by filter.
+func listRecords(f recordFilter, types ...string) []adminRecord {
+	out := make([]adminRecord, 0)
+
+	db.Range(func(key, val interface{}) bool {
+		id, ok := key.(string)
+		if !ok {
+			return true
+		}
+
+		record, ok := val.(captchaDBRecord)
+		if !ok || record.Expires.Before(time.Now()) || !f.match(record) {
+			return true
+		}
+
+		for _, t := range types {
+			if record.Type == t {
+				out = append(out, adminRecord{
+					ID:        id,
+					Type:      record.Type,
+					Domain:    record.Domain,
+					Address:   record.Address,
+					UserAgent: record.UserAgent,
+					Issued:    record.Issued,
+					Expires:   record.Expires,
+				})
+
+				break
+			}
+		}
+
+		return true
+	})
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Issued.Before(out[j].Issued)
+	})
+
+	return out
+}
+
+// writeAdminJSON writes admin API response.
+func writeAdminJSON(w http.ResponseWriter, r *http.Request, code int, v interface{}) {
+	if err := writeJSON(w, code, v); err != nil {
+		logMessage(
+			slog.LevelDebug, messageFailedHTTPResponse,
+			"status", code,
+			"remote_addr", r.RemoteAddr,
+			"uri", r.URL.Path,
+		)
+	}
+}
+
+// writeAdminError writes admin API error response.
+func writeAdminError(w http.ResponseWriter, r *http.Request, code int, message string) {
+	writeAdminJSON(w, r, code, apiError{Status: code, Error: message})
+}
+
+// adminAuth requires bearer token, without configured token only unix socket admin listener is allowed.
+func adminAuth(h http.HandlerFunc) http.HandlerFunc {
+	return requireAdminToken(h, false)
+}
+
+// dashboardAuth requires bearer token or basic authentication with token as password,
+// basic authentication is sent by browsers automatically and is accepted only by read-only dashboard.
+func dashboardAuth(h http.HandlerFunc) http.HandlerFunc {
+	return requireAdminToken(h, true)
+}
+
+// requireAdminToken requires admin token, basic authentication is accepted when allowBasic is set.
+func requireAdminToken(h http.HandlerFunc, allowBasic bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminToken == nil {
+			if !strings.HasPrefix(cmdAdminAddress, "unix:") {
+				writeAdminError(w, r, http.StatusForbidden, messageAdminTokenRequired)
+
+				return
+			}
+
+			h(w, r)
+
+			return
+		}
+
+		// browsers send token as basic authentication password
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok && allowBasic {
+			_, token, ok = r.BasicAuth()
+		}
+
+		if !ok || subtle.ConstantTimeCompare([]byte(token), adminToken) != 1 {
+			logMessage(
+				slog.LevelInfo, messageAdminUnauthorized,
+				"status", http.StatusUnauthorized,
+				"remote_addr", r.RemoteAddr,
+				"uri", r.URL.Path,
+			)
+
+			w.Header().Add("WWW-Authenticate", `Bearer realm="captcha-admin"`)
+
+			if allowBasic {
+				w.Header().Add("WWW-Authenticate", `Basic realm="captcha-admin", charset="UTF-8"`)
+			}
+
+			writeAdminError(w, r, http.StatusUnauthorized, messageAdminUnauthorized)
+
+			return
+		}
+
+		h(w, r)
+	}
+}
+
+// logAdminAction logs state changing admin API request.
+func logAdminAction(r *http.Request, reason string, args ...any) {
+	logMessage(slog.LevelInfo, reason, append([]any{
+		"remote_addr", r.RemoteAddr,
+		"uri", r.URL.Path,
+	}, args...)...)
+}
+
+func adminListSessionsHandle(w http.ResponseWriter, r *http.Request) {
+	records := listRecords(getRecordFilter(r), recordTypeSession)
+
+	list := adminRecordList{Count: len(records), Records: records}
+
+	// count only
+	if r.URL.Query().Has("count") {
+		list.Records = nil
+	}
+
+	writeAdminJSON(w, r, http.StatusOK, list)
+}
+
+func adminCreateSessionHandle(w http.ResponseWriter, r *http.Request) {
+	var req adminSessionRequest
+
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJSONBodyBytes)).Decode(&req); err != nil || req.Domain == "" {
+		writeAdminError(w, r, http.StatusBadRequest, messageInvalidRequest)
+
+		return
+	}
+
+	ttl := time.Duration(req.TTL)
+	if ttl <= 0 {
+		ttl = getPolicy(strings.TrimPrefix(req.Domain, ".")).getAuthTTL()
+	}
+
+	domain := strings.ToLower(req.Domain)
+
+	id, expires, err := storeSession(domain, req.UserAgent, req.Address, ttl)
+	if err != nil {
+		writeAdminError(w, r, http.StatusInternalServerError, messageFailedEntropy)
+
+		return
+	}
+
+	logAdminAction(r, messageAdminSession,
+		"domain", domain,
+		"auth_id", id,
+		"ttl", ttl.String(),
+	)
+
+	writeAdminJSON(w, r, http.StatusCreated, adminSession{
+		Token:      id,
+		CookieName: authenticationName,
+		Domain:     domain,
+		Expires:    expires,
+	})
+}
+
+func adminRevokeSessionHandle(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	val, ok := db.Load(id)
+	if record, isRecord := val.(captchaDBRecord); !ok || !isRecord || record.Type != recordTypeSession {
+		writeAdminError(w, r, http.StatusNotFound, messageUnknownAuthentication)
+
+		return
+	}
+
+	db.Delete(id)
+
+	logAdminAction(r, messageAdminRevoke, "auth_id", id)
+
+	writeAdminJSON(w, r, http.StatusOK, adminResult{Count: 1})
+}
+
+func adminRevokeSessionsHandle(w http.ResponseWriter, r *http.Request) {
+	f := getRecordFilter(r)
+
+	// refuse to revoke every session by accident
+	if f.isEmpty() {
+		writeAdminError(w, r, http.StatusBadRequest, messageAdminEmptyFilter)
+
+		return
+	}
+
+	records := listRecords(f, recordTypeSession)
+
+	for _, record := range records {
+		db.Delete(record.ID)
+	}
+
+	logAdminAction(r, messageAdminRevoke,
+		"domain", f.Domain,
+		"ip", f.Address,
+		"ua", f.UserAgent,
+		"count", len(records),
+	)
+
+	writeAdminJSON(w, r, http.StatusOK, adminResult{Count: len(records)})
+}
+
+func adminListChallengesHandle(w http.ResponseWriter, r *http.Request) {
+	records := listRecords(getRecordFilter(r), challengeTypeImage, challengeTypeJS, challengeTypeSlider)
+
+	list := adminRecordList{Count: len(records), Records: records}
+
+	// count only
+	if r.URL.Query().Has("count") {
+		list.Records = nil
+	}
+
+	writeAdminJSON(w, r, http.StatusOK, list)
+}
+
+func adminListBansHandle(w http.ResponseWriter, r *http.Request) {
+	writeAdminJSON(w, r, http.StatusOK, bans.List())
+}
+
+func adminLiftBanHandle(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+
+	if !bans.Lift(key) {
+		writeAdminError(w, r, http.StatusNotFound, messageAdminUnknownBan)
+
+		return
+	}
+
+	logAdminAction(r, messageAdminLiftBan, "ban", key)
+
+	writeAdminJSON(w, r, http.StatusOK, adminResult{Count: 1})
+}
+
+func adminReloadHandle(w http.ResponseWriter, r *http.Request) {
+	if err := reloadResources(); err != nil {
+		writeAdminError(w, r, http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	logAdminAction(r, messageAdminReload)
+
+	writeAdminJSON(w, r, http.StatusOK, adminResult{Count: 1})
+}
+
+// newAdminMux creates HTTP mux for admin listener.
+func newAdminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandle)
+	mux.HandleFunc("GET /healthz", healthzHandle)
+	mux.HandleFunc("GET /readyz", readyzHandle)
+	mux.HandleFunc("/log-level", adminAuth(logLevelHandle))
+
+	mux.HandleFunc("GET /api/sessions", adminAuth(adminListSessionsHandle))
+	mux.HandleFunc("POST /api/sessions", adminAuth(adminCreateSessionHandle))
+	mux.HandleFunc("DELETE /api/sessions", adminAuth(adminRevokeSessionsHandle))
+	mux.HandleFunc("DELETE /api/sessions/{id}", adminAuth(adminRevokeSessionHandle))
+	mux.HandleFunc("GET /api/challenges", adminAuth(adminListChallengesHandle))
+	mux.HandleFunc("GET /api/bans", adminAuth(adminListBansHandle))
+	mux.HandleFunc("DELETE /api/bans/{key...}", adminAuth(adminLiftBanHandle))
+	mux.HandleFunc("POST /api/reload", adminAuth(adminReloadHandle))
+
+	mux.HandleFunc("GET /dashboard", dashboardAuth(dashboardHandle))
+	mux.HandleFunc("GET /dashboard/stats", dashboardAuth(dashboardStatsHandle))
+	mux.HandleFunc("GET /dashboard/events", dashboardAuth(dashboardEventsHandle))
+
+	return mux
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+)
+
+// allowlistFile defines JSON allowlist file, rules are grouped by name that is logged on bypass.
+type allowlistFile struct {
+	// Networks defines IP addresses and CIDRs matched against X-Real-IP
+	Networks map[string][]string `json:"networks,omitempty"`
+	// APIKeys defines static keys matched against X-Captcha-Key header
+	APIKeys map[string]string `json:"api_keys,omitempty"`
+	// ClientCerts defines subject DNs of nginx verified client certificates, "*" matches any verified certificate
+	ClientCerts map[string][]string `json:"client_certs,omitempty"`
+}
+
+// allowNetwork defines named network rule.
+type allowNetwork struct {
+	Name   string
+	Prefix netip.Prefix
+}
+
+// allowAPIKey defines named API key rule.
+type allowAPIKey struct {
+	Name string
+	Key  []byte
+}
+
+// allowlist defines parsed allow rules.
+type allowlist struct {
+	Networks    []allowNetwork
+	APIKeys     []allowAPIKey
+	ClientCerts map[string]string
+}
+
+// parsePrefix parses IP address or CIDR.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+
+		return p.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+
+	return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+}
+
+// readAllowlist loads and validates JSON allowlist file.
+func readAllowlist(path string) (*allowlist, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("allowlist error: %w", err)
+	}
+
+	var in allowlistFile
+
+	if err = json.Unmarshal(b, &in); err != nil {
+		return nil, fmt.Errorf("allowlist error: %w", err)
+	}
+
+	out := &allowlist{
+		ClientCerts: make(map[string]string),
+	}
+
+	for name, networks := range in.Networks {
+		for _, network := range networks {
+			p, err := parsePrefix(strings.TrimSpace(network))
+			if err != nil {
+				return nil, fmt.Errorf("allowlist error: '%s': %w", name, err)
+			}
+
+			out.Networks = append(out.Networks, allowNetwork{Name: name, Prefix: p})
+		}
+	}
+
+	// most specific network wins
+	sort.SliceStable(out.Networks, func(i, j int) bool {
+		return out.Networks[i].Prefix.Bits() > out.Networks[j].Prefix.Bits()
+	})
+
+	for name, key := range in.APIKeys {
+		if len(key) < 16 {
+			return nil, fmt.Errorf("allowlist error: '%s': API key must be at least 16 characters", name)
+		}
+
+		out.APIKeys = append(out.APIKeys, allowAPIKey{Name: name, Key: []byte(key)})
+	}
+
+	for name, subjects := range in.ClientCerts {
+		for _, subject := range subjects {
+			subject = strings.TrimSpace(subject)
+			if subject == "" {
+				return nil, fmt.Errorf("allowlist error: '%s': empty client certificate subject", name)
+			}
+
+			if other, ok := out.ClientCerts[subject]; ok && other != name {
+				return nil, fmt.Errorf("allowlist error: client certificate subject '%s' in '%s' and '%s'", subject, other, name)
+			}
+
+			out.ClientCerts[subject] = name
+		}
+	}
+
+	return out, nil
+}
+
+// match returns name of rule that allows request to bypass captcha.
+func (a *allowlist) match(h http.Header) (string, bool) {
+	if addr, err := netip.ParseAddr(h.Get("X-Real-IP")); err == nil {
+		addr = addr.Unmap()
+
+		for _, n := range a.Networks {
+			if n.Prefix.Contains(addr) {
+				return "network:" + n.Name, true
+			}
+		}
+	}
+
+	if key := h.Get("X-Captcha-Key"); key != "" {
+		for _, k := range a.APIKeys {
+			if subtle.ConstantTimeCompare([]byte(key), k.Key) == 1 {
+				return "api-key:" + k.Name, true
+			}
+		}
+	}
+
+	// client certificate headers must always be set by nginx, see nginx/captcha_server.conf
+	if len(a.ClientCerts) > 0 && h.Get("X-SSL-Client-Verify") == "SUCCESS" {
+		if name, ok := a.ClientCerts[h.Get("X-SSL-Client-S-DN")]; ok {
+			return "client-cert:" + name, true
+		}
+
+		if name, ok := a.ClientCerts["*"]; ok {
+			return "client-cert:" + name, true
+		}
+	}
+
+	return "", false
+}
+
+// getAllowRule returns name of allow rule that matches request.
+func getAllowRule(h http.Header) (string, bool) {
+	a := allowed.Load()
+	if a == nil {
+		return "", false
+	}
+
+	return a.match(h)
+}
+
+// loadAllowlist reads allowlist file and replaces active allowlist.
+func loadAllowlist(path string) error {
+	a, err := readAllowlist(path)
+	if err != nil {
+		return err
+	}
+
+	allowed.Store(a)
+
+	return nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// apiError defines JSON error response.
+type apiError struct {
+	Status int    `json:"status"`
+	Error  string `json:"error"`
+}
+
+// apiConstraints defines JSON challenge response constraints.
+type apiConstraints struct {
+	// Length and Pattern define expected image captcha response
+	Length  int    `json:"length,omitempty"`
+	Pattern string `json:"pattern,omitempty"`
+	// MaxOffset defines maximal slider puzzle response
+	MaxOffset int `json:"max_offset,omitempty"`
+	// MinSolveTime defines minimal number of seconds before response is accepted
+	MinSolveTime float64 `json:"min_solve_time"`
+}
+
+// apiChallenge defines JSON challenge response.
+type apiChallenge struct {
+	Challenge string `json:"challenge"`
+	Type      string `json:"type"`
+
+	// Image is data URI of captcha image or slider puzzle background
+	Image string `json:"image"`
+	// Piece is data URI of slider puzzle piece
+	Piece  string `json:"piece,omitempty"`
+	PieceY int    `json:"piece_y,omitempty"`
+
+	// form input names for form encoded validation request
+	ChallengeKey  string `json:"challenge_key"`
+	ResponseKey   string `json:"response_key"`
+	TrajectoryKey string `json:"trajectory_key,omitempty"`
+
+	Expires     time.Time      `json:"expires"`
+	Constraints apiConstraints `json:"constraints"`
+}
+
+// apiValidationRequest defines JSON validation request.
+type apiValidationRequest struct {
+	Challenge  string `json:"challenge"`
+	Response   string `json:"response"`
+	Trajectory string `json:"trajectory,omitempty"`
+}
+
+// apiValidation defines JSON validation response.
+type apiValidation struct {
+	Success bool   `json:"success"`
+	Reason  string `json:"reason,omitempty"`
+
+	// Token is authentication ID, also set as cookie
+	Token      string     `json:"token,omitempty"`
+	CookieName string     `json:"cookie_name,omitempty"`
+	Expires    *time.Time `json:"expires,omitempty"`
+
+	// Redirect defines originally requested URI
+	Redirect string `json:"redirect,omitempty"`
+}
+
+// isAPIRequest checks that client requested JSON API mode.
+func isAPIRequest(h http.Header) bool {
+	if strings.EqualFold(h.Get("X-Captcha-API"), "TRUE") {
+		return true
+	}
+
+	for _, value := range strings.Split(h.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(value); err == nil && mediaType == "application/json" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isJSONBody checks that request body is JSON encoded.
+func isJSONBody(h http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+
+	return err == nil && mediaType == "application/json"
+}
+
+// writeJSON writes JSON encoded value with specified HTTP status code.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+
+	return json.NewEncoder(w).Encode(v)
+}
+
+// httpError replies with error message as plain text or, in API mode, as JSON.
+func httpError(w http.ResponseWriter, r *http.Request, message string, code int) {
+	setSpanOutcome(r, message)
+
+	if !isAPIRequest(r.Header) {
+		http.Error(w, message, code)
+
+		return
+	}
+
+	if err := writeJSON(w, code, apiError{Status: code, Error: message}); err != nil {
+		logEvent(slog.LevelDebug, r, code, messageFailedHTTPResponse)
+	}
+}
+
+// getValidationRequest reads validation request from form or JSON body.
+func getValidationRequest(w http.ResponseWriter, r *http.Request) (apiValidationRequest, error) {
+	var req apiValidationRequest
+
+	if isJSONBody(r.Header) {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJSONBodyBytes)).Decode(&req); err != nil {
+			return req, fmt.Errorf("validation request error: %w", err)
+		}
+
+		return req, nil
+	}
+
+	req.Challenge = r.PostFormValue(challengeKey)
+	req.Response = r.PostFormValue(responseKey)
+	req.Trajectory = r.PostFormValue(trajectoryKey)
+
+	return req, nil
+}
+
+// getRejectStatus returns HTTP code for rejected challenge response.
+func getRejectStatus(h http.Header) int {
+	if isAPIRequest(h) {
+		return http.StatusForbidden
+	}
+
+	return http.StatusSeeOther
+}
+
+// rejectChallenge redirects to self or, in API mode, replies with failed validation result.
+func rejectChallenge(w http.ResponseWriter, r *http.Request, message string) {
+	metricValidations.Inc(getMetricDomain(r.Header), getValidationOutcome(message))
+
+	setSpanOutcome(r, message)
+
+	emitEvent(event{
+		Type:      eventChallengeFailed,
+		Domain:    getRequestDomain(r.Header),
+		Address:   r.Header.Get("X-Real-IP"),
+		UserAgent: r.UserAgent(),
+		Reason:    message,
+	})
+
+	if !isAPIRequest(r.Header) {
+		// redirect to self
+		http.Redirect(w, r, getReturnURI(r.Header.Get("X-Original-URI")), http.StatusSeeOther)
+
+		return
+	}
+
+	if err := writeJSON(w, http.StatusForbidden, apiValidation{Reason: message}); err != nil {
+		logEvent(slog.LevelDebug, r, http.StatusForbidden, messageFailedHTTPResponse)
+	}
+}
+
+// newAPIChallenge creates JSON challenge response from template data.
+func newAPIChallenge(challengeType string, data templateData, expires time.Time) apiChallenge {
+	out := apiChallenge{
+		Challenge: data.TextHash,
+		Type:      challengeTypeImage,
+		Image:     "data:image/jpeg;base64," + data.Base64,
+
+		ChallengeKey: data.ChallengeKey,
+		ResponseKey:  data.ResponseKey,
+
+		Expires: expires,
+		Constraints: apiConstraints{
+			Length:       data.Length,
+			Pattern:      fmt.Sprintf("^[A-Za-z0-9]{%d}$", data.Length),
+			MinSolveTime: cmdMinSolveTime.Seconds(),
+		},
+	}
+
+	if challengeType == challengeTypeSlider {
+		out.Challenge = data.AltChallenge
+		out.Type = challengeTypeSlider
+		out.Image = "data:image/jpeg;base64," + data.SliderBackground
+		out.Piece = "data:image/png;base64," + data.SliderPiece
+		out.PieceY = data.SliderY
+		out.TrajectoryKey = data.TrajectoryKey
+		out.Constraints = apiConstraints{
+			MaxOffset:    data.SliderMax,
+			MinSolveTime: cmdMinSolveTime.Seconds(),
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// banRecord stores temporary ban of address or network prefix.
+type banRecord struct {
+	// Key defines banned address or network prefix
+	Key string `json:"key"`
+	// Reason defines last failure that led to ban
+	Reason string `json:"reason"`
+	// Count defines number of failures within window
+	Count int `json:"count"`
+	// Since defines time when ban was issued
+	Since time.Time `json:"since"`
+	// Until defines time when ban is lifted
+	Until time.Time `json:"until"`
+}
+
+// banList counts failures per address and per network prefix, keys over limit are banned for a duration.
+type banList struct {
+	mu       sync.Mutex
+	bans     map[string]banRecord
+	counter  *failureCounter
+	unsolved *failureCounter
+	solved   *failureCounter
+	duration time.Duration
+
+	// addressLimit and prefixLimit define number of failures within window that ban key, zero disables ban
+	addressLimit int
+	prefixLimit  int
+}
+
+// newBanList creates ban list with specified failure window, ban duration and limits.
+func newBanList(window, duration time.Duration, addressLimit, prefixLimit uint) *banList {
+	return &banList{
+		bans:         make(map[string]banRecord),
+		counter:      newFailureCounter(window),
+		unsolved:     newFailureCounter(window),
+		solved:       newFailureCounter(window),
+		duration:     duration,
+		addressLimit: int(addressLimit),
+		prefixLimit:  int(prefixLimit),
+	}
+}
+
+// getAddressPrefix returns network prefix of address, /24 for IPv4 and /64 for IPv6.
+func getAddressPrefix(address string) (string, string, bool) {
+	addr, err := netip.ParseAddr(address)
+	if err != nil {
+		return "", "", false
+	}
+
+	addr = addr.Unmap()
+
+	bits := banPrefixBitsIPv6
+	if addr.Is4() {
+		bits = banPrefixBitsIPv4
+	}
+
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return "", "", false
+	}
+
+	return addr.String(), prefix.String(), true
+}
+
+// ban issues ban for key, active ban is extended.
+func (b *banList) ban(key, reason string, count int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	record, ok := b.bans[key]
+	if !ok || record.Until.Before(time.Now()) {
+		record = banRecord{Key: key, Since: time.Now()}
+	}
+
+	record.Reason = reason
+	record.Count = count
+	record.Until = time.Now().Add(b.duration)
+
+	b.bans[key] = record
+
+	logBot(
+		bannedAccess, reason,
+		"ban", key,
+		"count", count,
+		"until", record.Until.Format(time.RFC3339),
+	)
+
+	emitEvent(event{
+		Type:   eventBanned,
+		Reason: reason,
+		Ban:    key,
+		Until:  &record.Until,
+	})
+}
+
+// Fail counts failure for address and its network prefix, network prefix alone counts failure for prefix only.
+func (b *banList) Fail(key, reason string) {
+	addr, prefix, ok := getAddressPrefix(key)
+	if !ok {
+		p, err := netip.ParsePrefix(key)
+		if err != nil {
+			return
+		}
+
+		addr, prefix = "", p.Masked().String()
+	}
+
+	if b.addressLimit > 0 && addr != "" {
+		if count := b.counter.Add(addr); count >= b.addressLimit {
+			b.ban(addr, reason, count)
+		}
+	}
+
+	if b.prefixLimit > 0 {
+		if count := b.counter.Add(prefix); count >= b.prefixLimit {
+			b.ban(prefix, reason, count)
+		}
+	}
+}
+
+// FailUnsolved counts unsolved challenge once per challenge lineage within window,
+// repeated challenges of a single client, like subresource requests and background tabs, are counted once.
+func (b *banList) FailUnsolved(key, lineage, reason string) {
+	if b.unsolved.Add(lineage) > 1 {
+		return
+	}
+
+	b.Fail(key, reason)
+}
+
+// Forgive subtracts one failure of address that solved challenge, once per window,
+// so that alternating failures and solves still lead to ban, network prefix counter is kept.
+func (b *banList) Forgive(address string) {
+	addr, _, ok := getAddressPrefix(address)
+	if !ok {
+		return
+	}
+
+	if b.solved.Add(addr) > 1 {
+		return
+	}
+
+	b.counter.Sub(addr)
+}
+
+// Check returns active ban of address or its network prefix.
+func (b *banList) Check(address string) (banRecord, bool) {
+	addr, prefix, ok := getAddressPrefix(address)
+	if !ok {
+		return banRecord{}, false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, key := range []string{addr, prefix} {
+		if record, ok := b.bans[key]; ok && record.Until.After(time.Now()) {
+			return record, true
+		}
+	}
+
+	return banRecord{}, false
+}
+
+// Lift removes ban of address or network prefix.
+func (b *banList) Lift(key string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.bans[key]; !ok {
+		return false
+	}
+
+	delete(b.bans, key)
+
+	// lifted key starts counting failures from zero
+	b.counter.Reset(key)
+
+	return true
+}
+
+// List returns active bans ordered by expiration.
+func (b *banList) List() []banRecord {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	out := make([]banRecord, 0, len(b.bans))
+
+	for _, record := range b.bans {
+		if record.Until.After(time.Now()) {
+			out = append(out, record)
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Until.Before(out[j].Until)
+	})
+
+	return out
+}
+
+// Clean removes expired bans and failure counters.
+func (b *banList) Clean() {
+	b.mu.Lock()
+
+	for key, record := range b.bans {
+		if record.Until.Before(time.Now()) {
+			delete(b.bans, key)
+		}
+	}
+
+	b.mu.Unlock()
+
+	b.counter.Clean()
+	b.unsolved.Clean()
+	b.solved.Clean()
+}
+
+// countFailure counts failed challenge to escalate difficulty and to ban repeated offenders.
+func countFailure(address, lineage, reason string) {
+	failures.Add(address)
+	failures.Add(lineage)
+
+	bans.Fail(address, reason)
+}
+
+// rejectBanned replies with ban status when request address is banned.
+func rejectBanned(w http.ResponseWriter, r *http.Request) bool {
+	record, ok := bans.Check(r.Header.Get("X-Real-IP"))
+	if !ok {
+		return false
+	}
+
+	logEvent(
+		slog.LevelDebug, r, bannedAccess, messageBanned,
+		"ban", record.Key,
+	)
+
+	// return proper HTTP error with headers
+	w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(record.Until).Seconds())+1))
+	httpError(w, r, messageBanned, bannedAccess)
+
+	return true
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBanListFailSolveFail(t *testing.T) {
+	b := newBanList(time.Hour, time.Hour, 3, 0)
+
+	// solver farm alternates failures and solves of a single address,
+	// only first solve within window is forgiven
+	for range 4 {
+		b.Fail("192.0.2.1", messageInvalidResponse)
+		b.Forgive("192.0.2.1")
+	}
+
+	record, ok := b.Check("192.0.2.1")
+	if !ok {
+		t.Fatalf("address not banned after alternating failures and solves, count %d", b.counter.Get("192.0.2.1"))
+	}
+
+	if record.Key != "192.0.2.1" || record.Count != 3 {
+		t.Errorf("ban record %+v, want key 192.0.2.1 and count 3", record)
+	}
+}
+
+func TestBanListForgive(t *testing.T) {
+	b := newBanList(time.Hour, time.Hour, 3, 0)
+
+	b.Fail("192.0.2.1", messageInvalidResponse)
+	b.Fail("192.0.2.1", messageInvalidResponse)
+	b.Forgive("192.0.2.1")
+
+	if got := b.counter.Get("192.0.2.1"); got != 1 {
+		t.Errorf("count after solve is %d, want 1", got)
+	}
+
+	b.Forgive("192.0.2.1")
+
+	if got := b.counter.Get("192.0.2.1"); got != 1 {
+		t.Errorf("count after second solve is %d, want 1", got)
+	}
+}
+
+func TestBanListFailUnsolved(t *testing.T) {
+	b := newBanList(time.Hour, time.Hour, 2, 0)
+
+	// subresource requests of a single page share lineage
+	for range 5 {
+		b.FailUnsolved("192.0.2.1", "lineage", messageUnsolvedExpired)
+	}
+
+	if _, ok := b.Check("192.0.2.1"); ok {
+		t.Fatal("address banned for unsolved challenges of a single lineage")
+	}
+
+	b.FailUnsolved("192.0.2.1", "", messageUnsolvedExpired)
+
+	if _, ok := b.Check("192.0.2.1"); !ok {
+		t.Fatal("address not banned for unsolved challenges of distinct lineages")
+	}
+}
+
+func TestBanListRecordBanKey(t *testing.T) {
+	prevRecords, prevAddress := cmdPrivacyRecords, cmdPrivacyAddress
+	t.Cleanup(func() {
+		cmdPrivacyRecords, cmdPrivacyAddress = prevRecords, prevAddress
+	})
+
+	tests := []struct {
+		records string
+		address string
+		key     string
+		banned  string
+	}{
+		{privacyRecordsFull, privacyModeNone, "192.0.2.1", "192.0.2.1"},
+		{privacyRecordsAnonymized, privacyModeTruncate, "192.0.2.0/24", "192.0.2.0/24"},
+		{privacyRecordsAnonymized, privacyModeHash, "192.0.2.0/24", "192.0.2.0/24"},
+		{privacyRecordsMinimal, privacyModeNone, "192.0.2.0/24", "192.0.2.0/24"},
+	}
+
+	for _, tt := range tests {
+		cmdPrivacyRecords, cmdPrivacyAddress = tt.records, tt.address
+
+		key := getRecordBanKey("192.0.2.1")
+		if key != tt.key {
+			t.Errorf("%s/%s: ban key %q, want %q", tt.records, tt.address, key, tt.key)
+		}
+
+		b := newBanList(time.Hour, time.Hour, 1, 1)
+		b.FailUnsolved(key, "", messageUnsolvedExpired)
+
+		record, ok := b.Check("192.0.2.1")
+		if !ok || record.Key != tt.banned {
+			t.Errorf("%s/%s: ban %+v, %v, want key %q", tt.records, tt.address, record, ok, tt.banned)
+		}
+
+		// placeholder address of truncated records is never banned
+		if _, ok := b.bans["192.0.2.0"]; ok {
+			t.Errorf("%s/%s: placeholder address banned", tt.records, tt.address)
+		}
+	}
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// configuration sources, later source overrides earlier one:
+// defaults < config file < environment variables < command line flags
+const (
+	configSourceDefault = "default"
+	configSourceFile    = "file"
+	configSourceEnv     = "env"
+	configSourceFlag    = "flag"
+)
+
+// configOption defines effective configuration value and its source.
+type configOption struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// newFlagSet defines all configuration options as command line flags.
+func newFlagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+
+	fs.StringVar(&cmdConfigPath, "config", "", "path to JSON config file with flag names as keys, also set with "+configEnvPrefix+"CONFIG")
+	fs.BoolVar(&cmdCheckConfig, "check-config", false, "validate configuration, print effective configuration and exit")
+
+	fs.StringVar(&cmdAddress, "address", "unix:/run/nginx-captcha.sock", `IP:PORT or Unix Socket path prefixd with "unix:"`)
+	fs.StringVar(&cmdDBPath, "db", "/var/cache/nginx-captcha/captcha.db", `path to CAPTCHA database`)
+	fs.UintVar(&cmdGenerate, "generate", 0, "specifies amount of unique CAPTHCAs to generate, zero has no action")
+	fs.UintVar(&cmdEscalateAfter, "escalate-after", 3, "number of failed challenges that raise difficulty level, zero disables escalation")
+	fs.DurationVar(&cmdEscalateCooldown, "escalate-cooldown", 15*time.Minute, "duration after last failed challenge when difficulty is reset")
+	fs.DurationVar(&cmdMinSolveTime, "min-solve-time", time.Second, "minimal duration between challenge render and response, faster responses are treated as automation")
+	fs.StringVar(&cmdChallengeType, "challenge-type", challengeTypeImage, `challenge type of domains without policy challenge type, "image", "js" browser-check or "slider" puzzle, both with image captcha fallback`)
+	fs.StringVar(&cmdSiteSecretsPath, "site-secrets", "", `path to widget site secrets file with "DOMAIN SECRET" lines, empty disables site verification`)
+	fs.StringVar(&cmdSSODomain, "sso-domain", "", "central captcha domain that issues SSO assertions, empty disables SSO")
+	fs.StringVar(&cmdSSODomains, "sso-domains", "", "comma separated list of domains allowed to take part in SSO")
+	fs.StringVar(&cmdSSOSecretPath, "sso-secret", "", "path to SSO assertion HMAC key file, at least 32 bytes")
+	fs.StringVar(&cmdTemplatesDir, "templates-dir", "", "path to directory with HTML template overrides named captcha.html, captcha-lite.html, captcha-js.html, captcha-slider.html and captcha-sso.html, reloaded on SIGHUP")
+	fs.StringVar(&cmdPolicyPath, "policy", "", "path to per-domain JSON policy file, reloaded on SIGHUP")
+	fs.StringVar(&cmdAllowlistPath, "allowlist", "", "path to JSON allowlist file with networks, API keys and client certificates that bypass captcha, reloaded on SIGHUP")
+	fs.StringVar(&cmdAdminAddress, "admin-address", "", `admin listener IP:PORT or Unix Socket path prefixed with "unix:", serves /metrics and admin API, empty disables admin listener`)
+	fs.StringVar(&cmdAdminTokenPath, "admin-token", "", "path to admin API bearer token file, at least 16 bytes, required for admin API on TCP listener")
+	fs.DurationVar(&cmdShutdownDelay, "shutdown-delay", 0, "duration service reports not ready on admin listener /readyz before it stops accepting requests on shutdown")
+	fs.DurationVar(&cmdShutdownTimeout, "shutdown-timeout", 10*time.Second, "maximal duration of waiting for in-flight requests on shutdown")
+	fs.UintVar(&cmdBanAfter, "ban-after", 20, "number of failed challenges and unsolved challenge lineages within ban window that ban address, solved challenge forgives one address failure per ban window, zero disables address bans")
+	fs.UintVar(&cmdBanPrefixAfter, "ban-prefix-after", 100, "number of failed challenges and unsolved challenge lineages within ban window that ban /24 IPv4 or /64 IPv6 network, zero disables network bans")
+	fs.DurationVar(&cmdBanWindow, "ban-window", 10*time.Minute, "duration failed and unsolved challenges are counted for bans")
+	fs.DurationVar(&cmdBanDuration, "ban-duration", time.Hour, "duration of temporary ban")
+	fs.StringVar(&cmdDenyFile, "deny-file", "", "path to nginx geo include file with banned addresses and networks, empty disables deny list")
+	fs.StringVar(&cmdDenyReloadCommand, "deny-reload-command", "", `command run after deny list update, like "nginx -s reload"`)
+	fs.DurationVar(&cmdDenyInterval, "deny-interval", time.Minute, "deny list update interval")
+	fs.UintVar(&cmdDenyBotAfter, "deny-bot-after", 50, "number of Bot events of address that add it to deny list alongside bans, zero disables Bot event entries")
+	fs.DurationVar(&cmdDenyBotWindow, "deny-bot-window", 10*time.Minute, "duration since last Bot event that address stays in deny list, at most one hour")
+	fs.BoolVar(&cmdCrawlerVerify, "crawler-verify", false, "allow search engine crawlers confirmed with forward-confirmed reverse DNS")
+	fs.StringVar(&cmdCrawlerResolver, "crawler-resolver", "", "DNS server IP:PORT for crawler verification, empty uses system resolver")
+	fs.DurationVar(&cmdCrawlerCacheTTL, "crawler-cache-ttl", time.Hour, "duration crawler verification verdict is cached per address")
+	fs.StringVar(&cmdEventSinks, "event-sinks", "", `comma separated event sink targets, "http(s)://URL" webhook, "unixgram:PATH" JSON datagrams or "syslog:[PATH]" RFC 5424 messages, empty disables events, set webhook URL with credentials in config file`)
+	fs.StringVar(&cmdEventTypes, "event-types", "", `comma separated event types sent to sinks, "challenge_issued", "challenge_solved", "challenge_failed", "challenge_expired" or "banned", empty sends all`)
+	fs.UintVar(&cmdEventQueue, "event-queue", 1024, "number of events queued per sink, events are dropped when queue is full")
+	fs.UintVar(&cmdEventRetries, "event-retries", 3, "number of event delivery retries")
+	fs.DurationVar(&cmdEventTimeout, "event-timeout", 5*time.Second, "event delivery timeout")
+	fs.StringVar(&cmdTraceEndpoint, "trace-endpoint", "", "OTLP/HTTP collector URL, spans are posted with JSON encoding to /v1/traces, empty disables tracing")
+	fs.StringVar(&cmdTraceHeadersPath, "trace-headers", "", `path to file with "NAME: VALUE" header of span export requests per line, like collector credentials`)
+	fs.StringVar(&cmdTraceServiceName, "trace-service-name", "nginx-captcha", "service name of exported spans")
+	fs.Float64Var(&cmdTraceSampleRatio, "trace-sample-ratio", 1, "sampling ratio of requests, requests with incoming traceparent header that is not sampled are never traced")
+	fs.BoolVar(&cmdLogDateTime, "log-date-time", true, "add date/time to log output")
+	fs.BoolVar(&cmdDebug, "debug", false, "enable debug logging with source location, overrides log level")
+	fs.StringVar(&cmdLogFormat, "log-format", logFormatJSON, `log output format, "json" or "logfmt"`)
+	fs.StringVar(&cmdLogOutput, "log-output", logOutputStdout, `log output, "stdout" with errors on stderr, "syslog[:PATH]" RFC 5424 messages to local socket, /dev/log by default, or "journald[:PATH]" native journal protocol`)
+	fs.StringVar(&cmdLogFacility, "log-facility", "daemon", "syslog facility of log records on syslog and journald outputs")
+	fs.StringVar(&cmdLogTag, "log-tag", "nginx-captcha", "syslog tag of log records on syslog and journald outputs")
+	fs.StringVar(&cmdLogBotFacility, "log-bot-facility", "daemon", "syslog facility of Bot log records on syslog and journald outputs")
+	fs.StringVar(&cmdLogBotTag, "log-bot-tag", "nginx-captcha-bot", "syslog tag of Bot log records on syslog and journald outputs, allows routing them separately")
+	fs.StringVar(&cmdLogLevel, "log-level", "info", `minimal log level, "debug", "info", "bot", "warn" or "error", changed at runtime on admin listener /log-level`)
+	fs.StringVar(&cmdPrivacyAddress, "privacy-address", privacyModeNone, `client address in logs, "none", "truncate" to /24 IPv4 or /48 IPv6 network, or "hash" with privacy key`)
+	fs.StringVar(&cmdPrivacyUserAgent, "privacy-user-agent", privacyModeNone, `client UA in logs, "none", "hash" with privacy key or "omit"`)
+	fs.BoolVar(&cmdPrivacyRedact, "privacy-redact", false, "replace authentication IDs, widget tokens and captcha responses in logs with keyed hash fingerprints")
+	fs.StringVar(&cmdPrivacyRecords, "privacy-records", privacyRecordsFull, `client address and UA kept in challenge and session records, "full", "anonymized" or "minimal" that disables UA and address binding, unsolved challenges of anonymized and minimal records count towards network bans only`)
+	fs.StringVar(&cmdPrivacyKeyPath, "privacy-key", "", "path to keyed hashing key file, at least 32 bytes, empty generates key that changes on restart")
+	fs.UintVar(&cmdLogSampleInitial, "log-sample-initial", 100, "number of events with the same level and reason logged each second before sampling, errors and Bot events are never sampled, zero disables sampling")
+	fs.UintVar(&cmdLogSampleThereafter, "log-sample-thereafter", 100, "log every Nth event with the same level and reason after initial events each second, zero drops them")
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of %s:\n", fs.Name())
+		fs.PrintDefaults()
+		fmt.Fprintf(fs.Output(),
+			"\nOptions are read from defaults, config file, environment variables and flags, later source wins.\n"+
+				"Environment variable name is option name in upper case prefixed with %s, like %sMIN_SOLVE_TIME.\n",
+			configEnvPrefix, configEnvPrefix,
+		)
+	}
+
+	return fs
+}
+
+// isCommandOnlyOption checks that option is set only with command line flag or environment variable.
+func isCommandOnlyOption(name string) bool {
+	return name == "config" || name == "check-config"
+}
+
+// getEnvName returns environment variable name for option.
+func getEnvName(name string) string {
+	return configEnvPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// readConfigFile reads JSON config file, keys are option names and values are strings, numbers or booleans.
+func readConfigFile(path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("config error: %w", err)
+	}
+
+	var raw map[string]json.RawMessage
+
+	if err = json.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("config error: %w", err)
+	}
+
+	values := make(map[string]string, len(raw))
+
+	for name, val := range raw {
+		var s string
+
+		// strings are unquoted, numbers and booleans are used as is
+		if err = json.Unmarshal(val, &s); err != nil {
+			s = string(val)
+		}
+
+		values[name] = s
+	}
+
+	return values, nil
+}
+
+// configure applies configuration from all sources and returns effective configuration.
+func configure(args []string) ([]configOption, error) {
+	fs := newFlagSet()
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("config error: unexpected argument '%s'", fs.Arg(0))
+	}
+
+	sources := make(map[string]string)
+
+	// options set with command line flags
+	fs.Visit(func(f *flag.Flag) {
+		sources[f.Name] = configSourceFlag
+	})
+
+	// config file path may also be defined with environment variable
+	if _, ok := sources["config"]; !ok {
+		if val, ok := os.LookupEnv(getEnvName("config")); ok {
+			cmdConfigPath = val
+			sources["config"] = configSourceEnv
+		}
+	}
+
+	// apply environment variables
+	var err error
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if _, ok := sources[f.Name]; ok || err != nil {
+			return
+		}
+
+		val, ok := os.LookupEnv(getEnvName(f.Name))
+		if !ok {
+			return
+		}
+
+		if err = f.Value.Set(val); err != nil {
+			err = fmt.Errorf("config error: invalid value '%s' for '%s': %w", val, getEnvName(f.Name), err)
+
+			return
+		}
+
+		sources[f.Name] = configSourceEnv
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	// apply config file
+	if cmdConfigPath != "" {
+		values, err := readConfigFile(cmdConfigPath)
+		if err != nil {
+			return nil, err
+		}
+
+		for name, val := range values {
+			f := fs.Lookup(name)
+			if f == nil || isCommandOnlyOption(name) {
+				return nil, fmt.Errorf("config error: unknown option '%s' in '%s'", name, cmdConfigPath)
+			}
+
+			if _, ok := sources[name]; ok {
+				continue
+			}
+
+			if err = f.Value.Set(val); err != nil {
+				return nil, fmt.Errorf("config error: invalid value '%s' for '%s': %w", val, name, err)
+			}
+
+			sources[name] = configSourceFile
+		}
+	}
+
+	if err = validateConfig(); err != nil {
+		return nil, err
+	}
+
+	// collect effective configuration
+	options := make([]configOption, 0, len(sources))
+
+	fs.VisitAll(func(f *flag.Flag) {
+		source, ok := sources[f.Name]
+		if !ok {
+			source = configSourceDefault
+		}
+
+		options = append(options, configOption{
+			Name:   f.Name,
+			Value:  f.Value.String(),
+			Source: source,
+		})
+	})
+
+	return options, nil
+}
+
+// validateConfig checks option values that do not depend on external files.
+func validateConfig() error {
+	switch {
+	case strings.TrimPrefix(cmdAddress, "unix:") == "":
+		return errors.New("config error: empty address")
+	case cmdAdminAddress != "" && cmdAdminAddress == cmdAddress:
+		return errors.New("config error: admin address must differ from service address")
+	case cmdLogFormat != logFormatJSON && cmdLogFormat != logFormatLogfmt:
+		return fmt.Errorf("config error: unknown log format '%s'", cmdLogFormat)
+	case !isLogOutput(cmdLogOutput):
+		return fmt.Errorf("config error: unknown log output '%s'", cmdLogOutput)
+	case cmdPrivacyAddress != privacyModeNone && cmdPrivacyAddress != privacyModeTruncate && cmdPrivacyAddress != privacyModeHash:
+		return fmt.Errorf("config error: unknown address privacy mode '%s'", cmdPrivacyAddress)
+	case cmdPrivacyUserAgent != privacyModeNone && cmdPrivacyUserAgent != privacyModeHash && cmdPrivacyUserAgent != privacyModeOmit:
+		return fmt.Errorf("config error: unknown user-agent privacy mode '%s'", cmdPrivacyUserAgent)
+	case cmdPrivacyRecords != privacyRecordsFull && cmdPrivacyRecords != privacyRecordsAnonymized && cmdPrivacyRecords != privacyRecordsMinimal:
+		return fmt.Errorf("config error: unknown record privacy mode '%s'", cmdPrivacyRecords)
+	case cmdAdminAddress == "" && cmdAdminTokenPath != "":
+		return errors.New("config error: admin token requires admin address")
+	case cmdDBPath == "":
+		return errors.New("config error: empty CAPTCHA database path")
+	case cmdChallengeType != challengeTypeImage && cmdChallengeType != challengeTypeJS && cmdChallengeType != challengeTypeSlider:
+		return fmt.Errorf("config error: unknown challenge type '%s'", cmdChallengeType)
+	case cmdMinSolveTime < 0:
+		return errors.New("config error: negative minimal solve time")
+	case cmdMinSolveTime >= time.Duration(challengeExpirationSeconds*nanoSecondsInSecond):
+		return errors.New("config error: minimal solve time must be shorter than challenge expiration")
+	case cmdEscalateAfter > 0 && cmdEscalateCooldown <= 0:
+		return errors.New("config error: escalation cooldown must be positive")
+	case cmdSSODomain != "" && cmdSSOSecretPath == "":
+		return errors.New("config error: SSO domain requires SSO secret")
+	case cmdSSODomain == "" && cmdSSODomains != "":
+		return errors.New("config error: SSO domains require SSO domain")
+	case cmdBanWindow <= 0 || cmdBanDuration <= 0:
+		return errors.New("config error: ban window and duration must be positive")
+	case cmdDenyFile != "" && cmdDenyInterval <= 0:
+		return errors.New("config error: deny list interval must be positive")
+	case cmdDenyFile == "" && cmdDenyReloadCommand != "":
+		return errors.New("config error: deny list reload command requires deny list file")
+	case cmdDenyBotAfter > 0 && (cmdDenyBotWindow <= 0 || cmdDenyBotWindow > offenderWindow):
+		return errors.New("config error: deny list Bot event window must be positive and at most one hour")
+	case cmdShutdownDelay < 0 || cmdShutdownTimeout <= 0:
+		return errors.New("config error: shutdown delay must not be negative and shutdown timeout must be positive")
+	case cmdEventSinks != "" && (cmdEventQueue == 0 || cmdEventTimeout <= 0):
+		return errors.New("config error: event queue and timeout must be positive")
+	case cmdTraceSampleRatio < 0 || cmdTraceSampleRatio > 1:
+		return errors.New("config error: trace sample ratio must be between 0 and 1")
+	case cmdCrawlerCacheTTL <= 0:
+		return errors.New("config error: crawler cache TTL must be positive")
+	}
+
+	if _, err := parseLogLevel(cmdLogLevel); err != nil {
+		return fmt.Errorf("config error: %w", err)
+	}
+
+	for _, facility := range []string{cmdLogFacility, cmdLogBotFacility} {
+		if _, err := getSyslogFacility(facility); err != nil {
+			return fmt.Errorf("config error: %w", err)
+		}
+	}
+
+	if cmdCrawlerResolver != "" {
+		if _, _, err := net.SplitHostPort(cmdCrawlerResolver); err != nil {
+			return fmt.Errorf("config error: invalid crawler resolver: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// printConfig writes effective configuration, one option per line.
+func printConfig(w io.Writer, options []configOption) error {
+	for _, o := range options {
+		if isCommandOnlyOption(o.Name) && o.Name != "config" {
+			continue
+		}
+
+		value := o.Value
+
+		// webhook URLs may contain credentials
+		if o.Name == "event-sinks" {
+			value = redactEventSinks(value)
+		}
+
+		if _, err := fmt.Fprintf(w, "%s=%q (%s)\n", o.Name, value, o.Source); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// initLoggers creates logger according to configuration.
+func initLoggers() {
+	// parsed in validateConfig
+	level, _ := parseLogLevel(cmdLogLevel)
+	if cmdDebug {
+		level = slog.LevelDebug
+	}
+
+	logLevel.Set(level)
+
+	logger = slog.New(newSamplingHandler(
+		newLogOutputHandler(cmdLogOutput, cmdLogFormat),
+		uint64(cmdLogSampleInitial), uint64(cmdLogSampleThereafter), time.Second,
+	))
+}
+
+// initState initializes runtime state that depends on configuration.
+func initState() error {
+	var err error
+
+	// read keyed hashing key for anonymized values
+	privacyKey, err = readPrivacyKey(cmdPrivacyKeyPath)
+	if err != nil {
+		return err
+	}
+
+	// initialize failure counters
+	failures = newFailureCounter(cmdEscalateCooldown)
+
+	// initialize ban list
+	bans = newBanList(cmdBanWindow, cmdBanDuration, cmdBanAfter, cmdBanPrefixAfter)
+
+	// initialize offending address tracker
+	offenders = newOffenderTracker(offenderWindow, offenderLimit)
+
+	// initialize solve time distributions
+	solveTimes = newSolveTimes()
+
+	// initialize metrics
+	metricChallengesIssued = newCounterVec("captcha_challenges_issued_total", "Number of issued challenges.", "domain", "type")
+	metricValidations = newCounterVec("captcha_validations_total", "Number of challenge validations by outcome.", "domain", "outcome")
+	metricAuthDecisions = newCounterVec("captcha_auth_decisions_total", "Number of authentication decisions by reason.", "domain", "reason")
+	metricHandlerDuration = newHistogramVec(
+		"captcha_handler_duration_seconds", "Handler latency.",
+		[]float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}, "handler",
+	)
+	metricDomains = newMetricDomainSet(metricDomainLimit)
+	metricEvents = newCounterVec("captcha_events_total", "Number of events by sink and delivery outcome.", "sink", "outcome")
+
+	// initialize event sinks
+	if cmdEventSinks != "" {
+		events, err = newEventDispatcher(cmdEventSinks, cmdEventTypes, cmdEventQueue, cmdEventRetries, cmdEventTimeout)
+		if err != nil {
+			return err
+		}
+	}
+
+	// initialize span exporter
+	if cmdTraceEndpoint != "" {
+		tracer, err = newSpanExporter(cmdTraceEndpoint, cmdTraceHeadersPath, cmdTraceServiceName)
+		if err != nil {
+			return err
+		}
+	}
+
+	// initialize crawler verifier
+	if cmdCrawlerVerify {
+		crawlers = newCrawlerVerifier(newDNSResolver(cmdCrawlerResolver), cmdCrawlerCacheTTL, crawlerVerdictLimit)
+	}
+
+	reUUID, err = regexp.Compile(regExpUUIDv4)
+	if err != nil {
+		return fmt.Errorf("regexp compile error: %w", err)
+	}
+
+	return nil
+}
+
+// reloadOnSignal reloads CAPTCHA db, templates, policy, allowlist and site secrets files each time SIGHUP is received,
+// invalid file keeps previous state.
+func reloadOnSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+
+	for range c {
+		_ = reloadResources()
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// crawler defines search engine crawler that is confirmed with forward-confirmed reverse DNS.
+type crawler struct {
+	// Name defines crawler name used in logs
+	Name string
+	// Agent defines case-insensitive User-Agent substring
+	Agent string
+	// Domains defines domains that crawler hostnames belong to
+	Domains []string
+}
+
+// knownCrawlers defines crawlers with documented reverse DNS verification.
+var knownCrawlers = []crawler{
+	{Name: "googlebot", Agent: "googlebot", Domains: []string{"googlebot.com", "google.com"}},
+	{Name: "bingbot", Agent: "bingbot", Domains: []string{"search.msn.com"}},
+	{Name: "yandexbot", Agent: "yandexbot", Domains: []string{"yandex.ru", "yandex.net", "yandex.com"}},
+	{Name: "baiduspider", Agent: "baiduspider", Domains: []string{"baidu.com", "baidu.jp"}},
+	{Name: "applebot", Agent: "applebot", Domains: []string{"applebot.apple.com"}},
+}
+
+// dnsResolver defines DNS lookups required for crawler verification, implemented by *net.Resolver.
+type dnsResolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// newDNSResolver creates resolver that uses DNS server at IP:PORT, empty address uses system resolver.
+func newDNSResolver(address string) dnsResolver {
+	if address == "" {
+		return net.DefaultResolver
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+
+			return d.DialContext(ctx, network, address)
+		},
+	}
+}
+
+// crawlerVerdict stores cached verification result.
+type crawlerVerdict struct {
+	// Valid defines that address is confirmed crawler address
+	Valid bool
+	// Host defines confirmed crawler hostname
+	Host string
+	// Expires defines when verdict must be verified again
+	Expires time.Time
+}
+
+// crawlerLookup stores result of running verification, done is closed when lookup finishes.
+type crawlerLookup struct {
+	done  chan struct{}
+	host  string
+	valid bool
+}
+
+// crawlerVerifier confirms crawler addresses and caches verdicts per address.
+type crawlerVerifier struct {
+	mu       sync.Mutex
+	verdicts map[string]crawlerVerdict
+	pending  map[string]*crawlerLookup
+	resolver dnsResolver
+	ttl      time.Duration
+	limit    int
+}
+
+// newCrawlerVerifier creates crawler verifier with specified resolver and verdict TTL,
+// at most limit verdicts are cached.
+func newCrawlerVerifier(resolver dnsResolver, ttl time.Duration, limit int) *crawlerVerifier {
+	return &crawlerVerifier{
+		verdicts: make(map[string]crawlerVerdict),
+		pending:  make(map[string]*crawlerLookup),
+		resolver: resolver,
+		ttl:      ttl,
+		limit:    limit,
+	}
+}
+
+// getCrawler returns known crawler that User-Agent claims to be.
+func getCrawler(ua string) (crawler, bool) {
+	ua = strings.ToLower(ua)
+
+	for _, c := range knownCrawlers {
+		if strings.Contains(ua, c.Agent) {
+			return c, true
+		}
+	}
+
+	return crawler{}, false
+}
+
+// isCrawlerHost checks that hostname belongs to crawler domains.
+func isCrawlerHost(c crawler, host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	for _, domain := range c.Domains {
+		if strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isDNSNotFound checks that lookup error is definitive answer that name does not exist.
+func isDNSNotFound(err error) bool {
+	var dnsErr *net.DNSError
+
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// lookup performs forward-confirmed reverse DNS, returns confirmed hostname,
+// error is returned when result is not definitive because of resolver failure.
+func (v *crawlerVerifier) lookup(c crawler, addr netip.Addr) (string, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), crawlerLookupTimeout)
+	defer cancel()
+
+	hosts, err := v.resolver.LookupAddr(ctx, addr.String())
+	if err != nil {
+		if isDNSNotFound(err) {
+			return "", false, nil
+		}
+
+		return "", false, err
+	}
+
+	var lookupErr error
+
+	for _, host := range hosts {
+		if !isCrawlerHost(c, host) {
+			continue
+		}
+
+		// hostname must resolve back to the same address
+		ips, err := v.resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			if !isDNSNotFound(err) {
+				lookupErr = err
+			}
+
+			continue
+		}
+
+		for _, ip := range ips {
+			if val, ok := netip.AddrFromSlice(ip.IP); ok && val.Unmap() == addr {
+				return strings.TrimSuffix(host, "."), true, nil
+			}
+		}
+	}
+
+	return "", false, lookupErr
+}
+
+// Verify checks that address belongs to crawler, definitive verdicts are cached for TTL,
+// concurrent requests from the same address share single lookup.
+func (v *crawlerVerifier) Verify(c crawler, address string) (string, bool) {
+	addr, err := netip.ParseAddr(address)
+	if err != nil {
+		return "", false
+	}
+
+	addr = addr.Unmap()
+	key := c.Name + "|" + addr.String()
+
+	v.mu.Lock()
+
+	if verdict, ok := v.verdicts[key]; ok && verdict.Expires.After(time.Now()) {
+		v.mu.Unlock()
+
+		return verdict.Host, verdict.Valid
+	}
+
+	// wait for lookup that is already running
+	if l, ok := v.pending[key]; ok {
+		v.mu.Unlock()
+
+		<-l.done
+
+		return l.host, l.valid
+	}
+
+	l := &crawlerLookup{done: make(chan struct{})}
+	v.pending[key] = l
+
+	v.mu.Unlock()
+
+	l.host, l.valid, err = v.lookup(c, addr)
+	if err != nil {
+		logMessage(
+			slog.LevelWarn, messageCrawlerLookupFailed,
+			"crawler", c.Name,
+			"ip", addr.String(),
+			"error", err.Error(),
+		)
+	}
+
+	v.mu.Lock()
+
+	delete(v.pending, key)
+
+	// resolver failures are not cached, new verdicts are dropped when cache is full
+	if err == nil && len(v.verdicts) < v.limit {
+		v.verdicts[key] = crawlerVerdict{
+			Valid:   l.valid,
+			Host:    l.host,
+			Expires: time.Now().Add(v.ttl),
+		}
+	}
+
+	v.mu.Unlock()
+
+	close(l.done)
+
+	return l.host, l.valid
+}
+
+// Clean removes expired verdicts.
+func (v *crawlerVerifier) Clean() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for key, verdict := range v.verdicts {
+		if verdict.Expires.Before(time.Now()) {
+			delete(v.verdicts, key)
+		}
+	}
+}
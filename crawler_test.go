@@ -0,0 +1,271 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// stubDNS answers PTR, A and AAAA queries from static records over UDP.
+type stubDNS struct {
+	conn    net.PacketConn
+	ptr     map[string]string
+	addr    map[string]string
+	fail    atomic.Bool
+	delay   time.Duration
+	queries atomic.Int64
+}
+
+func newStubDNS(t *testing.T) *stubDNS {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &stubDNS{
+		conn: conn,
+		ptr:  make(map[string]string),
+		addr: make(map[string]string),
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	return s
+}
+
+// reverseName returns PTR query name of IPv4 address.
+func reverseName(ip string) string {
+	octets := strings.Split(ip, ".")
+
+	for i, j := 0, len(octets)-1; i < j; i, j = i+1, j-1 {
+		octets[i], octets[j] = octets[j], octets[i]
+	}
+
+	return strings.Join(octets, ".") + ".in-addr.arpa."
+}
+
+// serve answers queries until connection is closed, records must not change after start.
+func (s *stubDNS) serve() {
+	buf := make([]byte, 512)
+
+	for {
+		n, peer, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		var p dnsmessage.Parser
+
+		header, err := p.Start(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		q, err := p.Question()
+		if err != nil {
+			continue
+		}
+
+		go s.answer(peer, header.ID, q)
+	}
+}
+
+func (s *stubDNS) answer(peer net.Addr, id uint16, q dnsmessage.Question) {
+	if q.Type == dnsmessage.TypePTR {
+		s.queries.Add(1)
+	}
+
+	time.Sleep(s.delay)
+
+	header := dnsmessage.Header{ID: id, Response: true, Authoritative: true, RCode: dnsmessage.RCodeSuccess}
+	name := strings.ToLower(q.Name.String())
+	rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}
+
+	var resources []func(b *dnsmessage.Builder) error
+
+	switch {
+	case s.fail.Load():
+		header.RCode = dnsmessage.RCodeServerFailure
+	case q.Type == dnsmessage.TypePTR:
+		host, ok := s.ptr[name]
+		if !ok {
+			header.RCode = dnsmessage.RCodeNameError
+
+			break
+		}
+
+		resources = append(resources, func(b *dnsmessage.Builder) error {
+			return b.PTRResource(rh, dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(host)})
+		})
+	case q.Type == dnsmessage.TypeA:
+		ip, ok := s.addr[name]
+		if !ok {
+			header.RCode = dnsmessage.RCodeNameError
+
+			break
+		}
+
+		resources = append(resources, func(b *dnsmessage.Builder) error {
+			return b.AResource(rh, dnsmessage.AResource{A: netip.MustParseAddr(ip).As4()})
+		})
+	}
+
+	b := dnsmessage.NewBuilder(nil, header)
+	b.EnableCompression()
+
+	if err := b.StartQuestions(); err != nil {
+		return
+	}
+
+	if err := b.Question(q); err != nil {
+		return
+	}
+
+	if err := b.StartAnswers(); err != nil {
+		return
+	}
+
+	for _, add := range resources {
+		if err := add(&b); err != nil {
+			return
+		}
+	}
+
+	msg, err := b.Finish()
+	if err != nil {
+		return
+	}
+
+	_, _ = s.conn.WriteTo(msg, peer)
+}
+
+func newStubVerifier(s *stubDNS) *crawlerVerifier {
+	go s.serve()
+
+	return newCrawlerVerifier(newDNSResolver(s.conn.LocalAddr().String()), time.Hour, crawlerVerdictLimit)
+}
+
+func TestCrawlerVerify(t *testing.T) {
+	s := newStubDNS(t)
+
+	s.ptr[reverseName("66.249.66.1")] = "crawl-66-249-66-1.googlebot.com."
+	s.addr["crawl-66-249-66-1.googlebot.com."] = "66.249.66.1"
+	s.ptr[reverseName("66.249.66.2")] = "spoof.googlebot.com."
+	s.addr["spoof.googlebot.com."] = "192.0.2.1"
+	s.ptr[reverseName("34.1.2.3")] = "3.2.1.34.bc.googleusercontent.com."
+	s.addr["3.2.1.34.bc.googleusercontent.com."] = "34.1.2.3"
+
+	googlebot, _ := getCrawler("Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)")
+
+	tests := []struct {
+		address string
+		host    string
+		valid   bool
+	}{
+		{"66.249.66.1", "crawl-66-249-66-1.googlebot.com", true},
+		{"::ffff:66.249.66.1", "crawl-66-249-66-1.googlebot.com", true},
+		{"66.249.66.2", "", false},
+		{"34.1.2.3", "", false},
+		{"192.0.2.2", "", false},
+		{"invalid", "", false},
+	}
+
+	v := newStubVerifier(s)
+
+	for _, tt := range tests {
+		host, valid := v.Verify(googlebot, tt.address)
+		if host != tt.host || valid != tt.valid {
+			t.Errorf("Verify(%q) = %q, %v, want %q, %v", tt.address, host, valid, tt.host, tt.valid)
+		}
+	}
+
+	// definitive verdicts are cached
+	queries := s.queries.Load()
+
+	for _, tt := range tests {
+		v.Verify(googlebot, tt.address)
+	}
+
+	if got := s.queries.Load(); got != queries {
+		t.Errorf("cached verdicts sent %d PTR queries", got-queries)
+	}
+}
+
+func TestCrawlerVerifyResolverFailure(t *testing.T) {
+	s := newStubDNS(t)
+
+	s.ptr[reverseName("66.249.66.1")] = "crawl-66-249-66-1.googlebot.com."
+	s.addr["crawl-66-249-66-1.googlebot.com."] = "66.249.66.1"
+
+	googlebot, _ := getCrawler("Googlebot")
+	v := newStubVerifier(s)
+
+	s.fail.Store(true)
+
+	if _, valid := v.Verify(googlebot, "66.249.66.1"); valid {
+		t.Fatal("crawler verified while resolver fails")
+	}
+
+	// failure is not cached
+	s.fail.Store(false)
+
+	if _, valid := v.Verify(googlebot, "66.249.66.1"); !valid {
+		t.Fatal("crawler not verified after resolver recovered")
+	}
+}
+
+func TestCrawlerVerifyConcurrent(t *testing.T) {
+	s := newStubDNS(t)
+
+	s.ptr[reverseName("66.249.66.1")] = "crawl-66-249-66-1.googlebot.com."
+	s.addr["crawl-66-249-66-1.googlebot.com."] = "66.249.66.1"
+	s.delay = 200 * time.Millisecond
+
+	googlebot, _ := getCrawler("Googlebot")
+	v := newStubVerifier(s)
+
+	var wg sync.WaitGroup
+
+	for range 20 {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			if _, valid := v.Verify(googlebot, "66.249.66.1"); !valid {
+				t.Error("crawler not verified")
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if got := s.queries.Load(); got != 1 {
+		t.Errorf("concurrent verification sent %d PTR queries, want 1", got)
+	}
+}
+
+func TestCrawlerVerifyLimit(t *testing.T) {
+	s := newStubDNS(t)
+
+	go s.serve()
+
+	googlebot, _ := getCrawler("Googlebot")
+	v := newCrawlerVerifier(newDNSResolver(s.conn.LocalAddr().String()), time.Hour, 2)
+
+	for _, address := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		v.Verify(googlebot, address)
+	}
+
+	if len(v.verdicts) != 2 {
+		t.Errorf("cached %d verdicts, want 2", len(v.verdicts))
+	}
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// ctlClient defines admin API client used by ctl subcommand.
+type ctlClient struct {
+	client *http.Client
+	token  string
+	raw    bool
+	out    io.Writer
+}
+
+// ctlCommand defines ctl subcommand.
+type ctlCommand struct {
+	args string
+	help string
+	run  func(c *ctlClient, args []string) error
+}
+
+// ctlCommands defines ctl subcommands by name.
+var ctlCommands = map[string]ctlCommand{
+	"sessions":   {"[-domain DOMAIN] [-ip IP] [-ua UA] [-count]", "list active sessions", ctlSessions},
+	"challenges": {"[-domain DOMAIN] [-ip IP] [-ua UA] [-count]", "list pending challenges", ctlChallenges},
+	"revoke":     {"ID | -domain DOMAIN | -ip IP | -ua UA", "revoke one session or all matching sessions", ctlRevoke},
+	"issue":      {"-domain DOMAIN [-ua UA] [-ip IP] [-ttl TTL]", "issue session for monitoring probe", ctlIssue},
+	"bans":       {"", "list active bans", ctlBans},
+	"unban":      {"KEY", "lift ban of address or network", ctlUnban},
+	"reload":     {"", "reload CAPTCHA db, templates, policies, allowlist and site secrets", ctlReload},
+	"stats":      {"", "dump metrics", ctlStats},
+	"log-level":  {"[LEVEL]", "show or change log level", ctlLogLevel},
+}
+
+// newCtlClient creates admin API client for IP:PORT or unix socket path prefixed with "unix:".
+func newCtlClient(address, tokenPath string, timeout time.Duration) (*ctlClient, error) {
+	c := &ctlClient{
+		client: &http.Client{Timeout: timeout},
+		out:    os.Stdout,
+	}
+
+	if tokenPath != "" {
+		token, err := readAdminToken(tokenPath)
+		if err != nil {
+			return nil, err
+		}
+
+		c.token = string(token)
+	}
+
+	network, addr := "tcp", address
+	if socket, ok := strings.CutPrefix(address, "unix:"); ok {
+		network, addr = "unix", socket
+	}
+
+	dialer := new(net.Dialer)
+
+	c.client.Transport = &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}
+
+	return c, nil
+}
+
+// do sends admin API request, decodes JSON response to out and returns response body.
+func (c *ctlClient) do(method, path string, query url.Values, body, out interface{}) ([]byte, error) {
+	var reader io.Reader
+
+	// string is sent as plain text, other values as JSON
+	switch v := body.(type) {
+	case nil:
+	case string:
+		reader = strings.NewReader(v)
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("ctl error: %w", err)
+		}
+
+		reader = bytes.NewReader(b)
+	}
+
+	u := url.URL{Scheme: "http", Host: "nginx-captcha", Path: path, RawQuery: query.Encode()}
+
+	req, err := http.NewRequest(method, u.String(), reader)
+	if err != nil {
+		return nil, fmt.Errorf("ctl error: %w", err)
+	}
+
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	if _, ok := body.(string); !ok && body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("ctl error: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("ctl error: %w", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var apiErr apiError
+
+		if json.Unmarshal(b, &apiErr) == nil && apiErr.Error != "" {
+			return nil, fmt.Errorf("ctl error: %s: %s", resp.Status, apiErr.Error)
+		}
+
+		return nil, fmt.Errorf("ctl error: %s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+
+	if out != nil {
+		if err = json.Unmarshal(b, out); err != nil {
+			return nil, fmt.Errorf("ctl error: %w", err)
+		}
+	}
+
+	return b, nil
+}
+
+// print writes raw JSON response when requested, otherwise formats output with f.
+func (c *ctlClient) print(b []byte, f func(w *tabwriter.Writer)) error {
+	if c.raw {
+		_, err := fmt.Fprintln(c.out, strings.TrimSpace(string(b)))
+
+		return err
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+
+	f(w)
+
+	return w.Flush()
+}
+
+// newCtlFilterFlags defines record filter flags of ctl subcommand.
+func newCtlFilterFlags(name string) (*flag.FlagSet, url.Values, *bool) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	query := make(url.Values)
+
+	for _, f := range []struct {
+		name  string
+		usage string
+	}{
+		{"domain", "filter by domain"},
+		{"ip", "filter by client address"},
+		{"ua", "filter by client UA"},
+	} {
+		fs.Func(f.name, f.usage, func(s string) error {
+			query.Set(f.name, s)
+
+			return nil
+		})
+	}
+
+	count := fs.Bool("count", false, "print only number of records")
+
+	return fs, query, count
+}
+
+// formatCtlTime formats record time in local time zone.
+func formatCtlTime(t time.Time) string {
+	return t.Local().Format(time.RFC3339)
+}
+
+// ctlRecords lists db records of admin API path.
+func ctlRecords(c *ctlClient, name, path string, args []string) error {
+	fs, query, count := newCtlFilterFlags(name)
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *count {
+		query.Set("count", "")
+	}
+
+	var list adminRecordList
+
+	b, err := c.do(http.MethodGet, path, query, nil, &list)
+	if err != nil {
+		return err
+	}
+
+	return c.print(b, func(w *tabwriter.Writer) {
+		if !*count {
+			fmt.Fprintln(w, "ID\tTYPE\tDOMAIN\tADDRESS\tEXPIRES\tUSER-AGENT")
+
+			for _, r := range list.Records {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+					r.ID, r.Type, r.Domain, r.Address, formatCtlTime(r.Expires), r.UserAgent,
+				)
+			}
+		}
+
+		fmt.Fprintf(w, "count: %d\n", list.Count)
+	})
+}
+
+func ctlSessions(c *ctlClient, args []string) error {
+	return ctlRecords(c, "sessions", "/api/sessions", args)
+}
+
+func ctlChallenges(c *ctlClient, args []string) error {
+	return ctlRecords(c, "challenges", "/api/challenges", args)
+}
+
+func ctlRevoke(c *ctlClient, args []string) error {
+	fs, query, _ := newCtlFilterFlags("revoke")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	path := "/api/sessions"
+
+	switch {
+	case fs.NArg() == 1 && len(query) == 0:
+		path += "/" + url.PathEscape(fs.Arg(0))
+	case fs.NArg() == 0 && len(query) > 0:
+	default:
+		return errors.New("ctl error: specify session ID or filter")
+	}
+
+	var result adminResult
+
+	b, err := c.do(http.MethodDelete, path, query, nil, &result)
+	if err != nil {
+		return err
+	}
+
+	return c.print(b, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "revoked: %d\n", result.Count)
+	})
+}
+
+func ctlIssue(c *ctlClient, args []string) error {
+	var req adminSessionRequest
+
+	fs := flag.NewFlagSet("issue", flag.ContinueOnError)
+	fs.StringVar(&req.Domain, "domain", "", "session domain, prefixed with '.' for wildcard domain")
+	fs.StringVar(&req.UserAgent, "ua", "", "client UA bound to session")
+	fs.StringVar(&req.Address, "ip", "", "client address bound to session")
+	ttl := fs.Duration("ttl", 0, "session TTL, zero uses domain policy")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if req.Domain == "" {
+		return errors.New("ctl error: domain is required")
+	}
+
+	req.TTL = duration(*ttl)
+
+	var session adminSession
+
+	b, err := c.do(http.MethodPost, "/api/sessions", nil, req, &session)
+	if err != nil {
+		return err
+	}
+
+	return c.print(b, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "cookie:\t%s=%s\n", session.CookieName, session.Token)
+		fmt.Fprintf(w, "domain:\t%s\n", session.Domain)
+		fmt.Fprintf(w, "expires:\t%s\n", formatCtlTime(session.Expires))
+	})
+}
+
+func ctlBans(c *ctlClient, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("ctl error: unexpected argument '%s'", args[0])
+	}
+
+	var list []banRecord
+
+	b, err := c.do(http.MethodGet, "/api/bans", nil, nil, &list)
+	if err != nil {
+		return err
+	}
+
+	return c.print(b, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "KEY\tCOUNT\tSINCE\tUNTIL\tREASON")
+
+		for _, r := range list {
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n",
+				r.Key, r.Count, formatCtlTime(r.Since), formatCtlTime(r.Until), r.Reason,
+			)
+		}
+
+		fmt.Fprintf(w, "count: %d\n", len(list))
+	})
+}
+
+func ctlUnban(c *ctlClient, args []string) error {
+	if len(args) != 1 {
+		return errors.New("ctl error: specify ban key")
+	}
+
+	b, err := c.do(http.MethodDelete, "/api/bans/"+args[0], nil, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	return c.print(b, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "lifted: %s\n", args[0])
+	})
+}
+
+func ctlReload(c *ctlClient, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("ctl error: unexpected argument '%s'", args[0])
+	}
+
+	b, err := c.do(http.MethodPost, "/api/reload", nil, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	return c.print(b, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "reloaded")
+	})
+}
+
+func ctlStats(c *ctlClient, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("ctl error: unexpected argument '%s'", args[0])
+	}
+
+	b, err := c.do(http.MethodGet, "/metrics", nil, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.out.Write(b)
+
+	return err
+}
+
+func ctlLogLevel(c *ctlClient, args []string) error {
+	var (
+		b   []byte
+		err error
+	)
+
+	switch len(args) {
+	case 0:
+		b, err = c.do(http.MethodGet, "/log-level", nil, nil, nil)
+	case 1:
+		b, err = c.do(http.MethodPut, "/log-level", nil, args[0], nil)
+	default:
+		return fmt.Errorf("ctl error: unexpected argument '%s'", args[1])
+	}
+
+	if err != nil {
+		return err
+	}
+
+	_, err = c.out.Write(b)
+
+	return err
+}
+
+// getCtlOption returns ctl option from flag, environment variable or config file, in that order.
+func getCtlOption(value, name, configPath string) (string, error) {
+	if value != "" {
+		return value, nil
+	}
+
+	if value = os.Getenv(getEnvName(name)); value != "" {
+		return value, nil
+	}
+
+	if configPath == "" {
+		return "", nil
+	}
+
+	values, err := readConfigFile(configPath)
+	if err != nil {
+		return "", err
+	}
+
+	return values[name], nil
+}
+
+// runCtl runs admin client subcommand against running service and returns exit code.
+func runCtl(args []string) int {
+	var (
+		configPath string
+		address    string
+		tokenPath  string
+		timeout    time.Duration
+		raw        bool
+	)
+
+	fs := flag.NewFlagSet("ctl", flag.ContinueOnError)
+	fs.StringVar(&configPath, "config", os.Getenv(getEnvName("config")), "path to service JSON config file used to find admin address and token")
+	fs.StringVar(&address, "admin-address", "", `admin listener IP:PORT or Unix Socket path prefixed with "unix:", default `+defaultCtlAddress)
+	fs.StringVar(&tokenPath, "admin-token", "", "path to admin API bearer token file")
+	fs.DurationVar(&timeout, "timeout", 10*time.Second, "admin API request timeout")
+	fs.BoolVar(&raw, "json", false, "print raw JSON responses")
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of %s ctl: [OPTIONS] COMMAND [ARGS]\n\nOptions:\n", os.Args[0])
+		fs.PrintDefaults()
+		fmt.Fprintf(fs.Output(), "\nCommands:\n")
+
+		w := tabwriter.NewWriter(fs.Output(), 0, 0, 2, ' ', 0)
+
+		for _, name := range []string{"sessions", "challenges", "revoke", "issue", "bans", "unban", "reload", "stats", "log-level"} {
+			fmt.Fprintf(w, "  %s %s\t%s\n", name, ctlCommands[name].args, ctlCommands[name].help)
+		}
+
+		w.Flush()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+
+		return 2
+	}
+
+	cmd, ok := ctlCommands[fs.Arg(0)]
+	if !ok {
+		fs.Usage()
+
+		return 2
+	}
+
+	var err error
+
+	if address, err = getCtlOption(address, "admin-address", configPath); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+
+		return 2
+	}
+
+	if address == "" {
+		address = defaultCtlAddress
+	}
+
+	if tokenPath, err = getCtlOption(tokenPath, "admin-token", configPath); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+
+		return 2
+	}
+
+	c, err := newCtlClient(address, tokenPath, timeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+
+		return 2
+	}
+
+	c.raw = raw
+
+	if err = cmd.run(c, fs.Args()[1:]); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		}
+
+		return 1
+	}
+
+	return 0
+}
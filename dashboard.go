@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// offender defines client address with Bot events.
+type offender struct {
+	Address string    `json:"address"`
+	Count   int       `json:"count"`
+	Domain  string    `json:"domain"`
+	Reason  string    `json:"reason"`
+	Last    time.Time `json:"last"`
+}
+
+// offenderTracker counts Bot events per client address.
+type offenderTracker struct {
+	mu      sync.Mutex
+	window  time.Duration
+	limit   int
+	entries map[string]*offender
+}
+
+// dashboardDomain defines challenge counts of domain.
+type dashboardDomain struct {
+	Domain string `json:"domain"`
+	Served uint64 `json:"served"`
+	Solved uint64 `json:"solved"`
+	Failed uint64 `json:"failed"`
+}
+
+// dashboardStats defines dashboard snapshot.
+type dashboardStats struct {
+	Time       time.Time         `json:"time"`
+	Domains    []dashboardDomain `json:"domains"`
+	Offenders  []offender        `json:"offenders"`
+	DB         captchaDBStatus   `json:"db"`
+	Sessions   int               `json:"sessions"`
+	Challenges map[string]int    `json:"challenges"`
+	Bans       int               `json:"bans"`
+}
+
+// newOffenderTracker creates tracker that forgets addresses without Bot events within window,
+// at most limit addresses are tracked.
+func newOffenderTracker(window time.Duration, limit int) *offenderTracker {
+	return &offenderTracker{
+		window:  window,
+		limit:   limit,
+		entries: make(map[string]*offender),
+	}
+}
+
+// Add counts Bot event of client address.
+func (t *offenderTracker) Add(address, domain, reason string) {
+	if address == "" {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entry, ok := t.entries[address]
+	if !ok {
+		// drop new addresses when tracker is full
+		if len(t.entries) >= t.limit {
+			return
+		}
+
+		entry = &offender{Address: address}
+		t.entries[address] = entry
+	}
+
+	entry.Count++
+	entry.Domain = domain
+	entry.Reason = reason
+	entry.Last = time.Now()
+}
+
+// Top returns n addresses with most Bot events.
+func (t *offenderTracker) Top(n int) []offender {
+	t.mu.Lock()
+
+	out := make([]offender, 0, len(t.entries))
+
+	for _, entry := range t.entries {
+		out = append(out, *entry)
+	}
+
+	t.mu.Unlock()
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+
+		return out[i].Address < out[j].Address
+	})
+
+	if len(out) > n {
+		out = out[:n]
+	}
+
+	return out
+}
+
+// List returns addresses with at least count Bot events and last event within window.
+func (t *offenderTracker) List(count int, window time.Duration) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	out := make([]string, 0)
+
+	for address, entry := range t.entries {
+		if entry.Count >= count && time.Since(entry.Last) <= window {
+			out = append(out, address)
+		}
+	}
+
+	return out
+}
+
+// Clean removes addresses without Bot events within window.
+func (t *offenderTracker) Clean() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for address, entry := range t.entries {
+		if time.Since(entry.Last) > t.window {
+			delete(t.entries, address)
+		}
+	}
+}
+
+// getBotEventValue returns value of key in Bot event log arguments.
+func getBotEventValue(args []any, key string) string {
+	for i := 0; i+1 < len(args); i += 2 {
+		if k, ok := args[i].(string); ok && k == key {
+			if v, ok := args[i+1].(string); ok {
+				return v
+			}
+		}
+	}
+
+	return ""
+}
+
+// getDashboardStats collects dashboard snapshot.
+func getDashboardStats() dashboardStats {
+	domains := make(map[string]*dashboardDomain)
+
+	getDomain := func(key string) *dashboardDomain {
+		name, _, _ := strings.Cut(key, "\xff")
+
+		d, ok := domains[name]
+		if !ok {
+			d = &dashboardDomain{Domain: name}
+			domains[name] = d
+		}
+
+		return d
+	}
+
+	for key, val := range metricChallengesIssued.Snapshot() {
+		getDomain(key).Served += val
+	}
+
+	for key, val := range metricValidations.Snapshot() {
+		if strings.HasSuffix(key, "\xffsuccess") {
+			getDomain(key).Solved += val
+		} else {
+			getDomain(key).Failed += val
+		}
+	}
+
+	stats := dashboardStats{
+		Time:      time.Now(),
+		Domains:   make([]dashboardDomain, 0, len(domains)),
+		Offenders: offenders.Top(dashboardTopOffenders),
+		Bans:      len(bans.List()),
+	}
+
+	for _, d := range domains {
+		stats.Domains = append(stats.Domains, *d)
+	}
+
+	sort.Slice(stats.Domains, func(i, j int) bool {
+		return stats.Domains[i].Served > stats.Domains[j].Served ||
+			stats.Domains[i].Served == stats.Domains[j].Served && stats.Domains[i].Domain < stats.Domains[j].Domain
+	})
+
+	// addresses are shown according to log privacy mode
+	for i := range stats.Offenders {
+		stats.Offenders[i].Address = anonymizeAddress(stats.Offenders[i].Address)
+	}
+
+	if status := captchaDBState.Load(); status != nil {
+		stats.DB = *status
+	}
+
+	stats.Sessions, stats.Challenges = countRecords()
+
+	return stats
+}
+
+func dashboardHandle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; connect-src 'self'")
+
+	if _, err := fmt.Fprint(w, dashboardHTML); err != nil {
+		logMessage(
+			slog.LevelDebug, messageFailedHTTPResponse,
+			"status", http.StatusOK,
+			"remote_addr", r.RemoteAddr,
+			"uri", r.URL.Path,
+		)
+	}
+}
+
+func dashboardStatsHandle(w http.ResponseWriter, r *http.Request) {
+	writeAdminJSON(w, r, http.StatusOK, getDashboardStats())
+}
+
+// dashboardEventsHandle streams dashboard snapshots as server-sent events.
+func dashboardEventsHandle(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	ticker := time.NewTicker(dashboardInterval)
+	defer ticker.Stop()
+
+	for {
+		b, err := json.Marshal(getDashboardStats())
+		if err != nil {
+			return
+		}
+
+		if _, err = fmt.Fprintf(w, "event: stats\ndata: %s\n\n", b); err != nil {
+			return
+		}
+
+		if err = rc.Flush(); err != nil {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
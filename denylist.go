@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// getDenyKeys returns banned addresses and networks merged with addresses of repeated Bot events.
+func getDenyKeys() []string {
+	keys := make(map[string]struct{})
+
+	for _, record := range bans.List() {
+		keys[record.Key] = struct{}{}
+	}
+
+	if cmdDenyBotAfter > 0 {
+		for _, address := range offenders.List(int(cmdDenyBotAfter), cmdDenyBotWindow) {
+			addr, err := netip.ParseAddr(address)
+			if err != nil {
+				// hashed and omitted addresses of anonymized records
+				continue
+			}
+
+			// truncated address of anonymized records is network placeholder, not client
+			if cmdPrivacyRecords == privacyRecordsAnonymized && truncateAddress(address) == address {
+				continue
+			}
+
+			keys[addr.Unmap().String()] = struct{}{}
+		}
+	}
+
+	out := make([]string, 0, len(keys))
+	for key := range keys {
+		out = append(out, key)
+	}
+
+	sort.Strings(out)
+
+	return out
+}
+
+// renderDenyList renders denied addresses and networks as nginx geo include file.
+func renderDenyList(keys []string) []byte {
+	var b bytes.Buffer
+
+	b.WriteString("# generated by nginx-captcha, do not edit\n")
+
+	for _, key := range keys {
+		fmt.Fprintf(&b, "%s 1;\n", key)
+	}
+
+	return b.Bytes()
+}
+
+// writeFileAtomic writes file to temporary path and renames it over destination.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+
+	// temporary file is removed unless renamed
+	defer os.Remove(f.Name())
+
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+
+		return err
+	}
+
+	if err = f.Chmod(0o644); err != nil {
+		f.Close()
+
+		return err
+	}
+
+	if err = f.Sync(); err != nil {
+		f.Close()
+
+		return err
+	}
+
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// runReloadCommand runs nginx reload command, command is split on white space.
+func runReloadCommand(command string) error {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), denyReloadTimeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// writeDenyList writes deny list include file from active bans and Bot events and reloads nginx when file changed.
+func writeDenyList(path, command string) {
+	var last []byte
+
+	// keep content written by previous run to avoid reload on start
+	if b, err := os.ReadFile(path); err == nil {
+		last = b
+	}
+
+	for {
+		data := renderDenyList(getDenyKeys())
+
+		if !bytes.Equal(data, last) {
+			if err := writeFileAtomic(path, data); err != nil {
+				logError(messageDenyListFailed, err, "path", path)
+			} else {
+				last = data
+
+				logInfo(messageDenyListWritten, "path", path, "entries", bytes.Count(data, []byte("\n"))-1)
+
+				if err = runReloadCommand(command); err != nil {
+					logError(messageDenyListReloadFailed, err, "command", command)
+				}
+			}
+		}
+
+		// sleep inside infinite loop
+		time.Sleep(cmdDenyInterval)
+	}
+}
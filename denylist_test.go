@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDenyListBotEvent(t *testing.T) {
+	prevBans, prevOffenders := bans, offenders
+	prevAfter, prevWindow := cmdDenyBotAfter, cmdDenyBotWindow
+	t.Cleanup(func() {
+		bans, offenders = prevBans, prevOffenders
+		cmdDenyBotAfter, cmdDenyBotWindow = prevAfter, prevWindow
+	})
+
+	bans = newBanList(time.Hour, time.Hour, 0, 0)
+	offenders = newOffenderTracker(offenderWindow, offenderLimit)
+	cmdDenyBotAfter, cmdDenyBotWindow = 2, time.Minute
+
+	botEvent := func(address string) {
+		logBot(
+			http.StatusForbidden, messageFilledHoneypot,
+			"domain", "example.com",
+			"remote_addr", address,
+		)
+	}
+
+	botEvent("192.0.2.1")
+	botEvent("192.0.2.1")
+	botEvent("::ffff:192.0.2.2")
+	botEvent("::ffff:192.0.2.2")
+	botEvent("h:0123456789abcdef")
+	botEvent("h:0123456789abcdef")
+	// single Bot event is below threshold
+	botEvent("192.0.2.3")
+
+	got := string(renderDenyList(getDenyKeys()))
+	want := "# generated by nginx-captcha, do not edit\n192.0.2.1 1;\n192.0.2.2 1;\n"
+
+	if got != want {
+		t.Errorf("deny list\n%s\nwant\n%s", got, want)
+	}
+
+	// Bot event entries are disabled
+	cmdDenyBotAfter = 0
+
+	if got := string(renderDenyList(getDenyKeys())); strings.Contains(got, "192.0.2.1") {
+		t.Errorf("deny list with disabled Bot event entries\n%s", got)
+	}
+}
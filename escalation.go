@@ -0,0 +1,136 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	captcha "github.com/s3rj1k/go-captcha"
+)
+
+// failureRecord stores number of failures for a single key.
+type failureRecord struct {
+	// Count defines number of failures since last reset
+	Count int
+	// Last defines time of last failure
+	Last time.Time
+}
+
+// failureCounter counts failures per key, counters are reset after cooldown.
+type failureCounter struct {
+	mu       sync.Mutex
+	records  map[string]failureRecord
+	cooldown time.Duration
+}
+
+// newFailureCounter creates failure counter with specified cooldown.
+func newFailureCounter(cooldown time.Duration) *failureCounter {
+	return &failureCounter{
+		records:  make(map[string]failureRecord),
+		cooldown: cooldown,
+	}
+}
+
+// Add increments failure counter for key and returns its new value.
+func (c *failureCounter) Add(key string) int {
+	if key == "" {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	record := c.records[key]
+
+	if time.Since(record.Last) > c.cooldown {
+		record.Count = 0
+	}
+
+	record.Count++
+	record.Last = time.Now()
+
+	c.records[key] = record
+
+	return record.Count
+}
+
+// Get returns failure counter value for key.
+func (c *failureCounter) Get(key string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	record, ok := c.records[key]
+	if !ok || time.Since(record.Last) > c.cooldown {
+		return 0
+	}
+
+	return record.Count
+}
+
+// Sub decrements failure counter for key, counter does not go below zero and keeps its cooldown.
+func (c *failureCounter) Sub(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	record, ok := c.records[key]
+	if !ok || record.Count == 0 {
+		return
+	}
+
+	record.Count--
+
+	c.records[key] = record
+}
+
+// Reset removes failure counter for key.
+func (c *failureCounter) Reset(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.records, key)
+}
+
+// Clean removes failure counters which are past cooldown.
+func (c *failureCounter) Clean() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, record := range c.records {
+		if time.Since(record.Last) > c.cooldown {
+			delete(c.records, key)
+		}
+	}
+}
+
+// getDifficulty returns challenge difficulty level for client address and challenge lineage.
+func getDifficulty(address, lineage string) int {
+	if cmdEscalateAfter == 0 {
+		return 0
+	}
+
+	count := failures.Get(address)
+
+	if lineage != "" {
+		count = max(count, failures.Get(lineage))
+	}
+
+	return min(count/int(cmdEscalateAfter), maxDifficultyLevel)
+}
+
+// newEscalatedOptions creates CAPTCHA generation profiles for each difficulty level above zero.
+func newEscalatedOptions() ([]*captcha.Options, error) {
+	options := make([]*captcha.Options, 0, maxDifficultyLevel)
+
+	for level := 1; level <= maxDifficultyLevel; level++ {
+		captchaConfig, err := newCaptchaOptions(
+			defaultCaptchaLength+level,
+			defaultNoiseDensity*float64(1+level),
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		options = append(options, captchaConfig)
+	}
+
+	return options, nil
+}
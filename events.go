@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// event defines captcha event delivered to event sinks.
+type event struct {
+	Type      string     `json:"type"`
+	Time      time.Time  `json:"time"`
+	Domain    string     `json:"domain,omitempty"`
+	Address   string     `json:"address,omitempty"`
+	UserAgent string     `json:"user_agent,omitempty"`
+	Challenge string     `json:"challenge_type,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+	Ban       string     `json:"ban,omitempty"`
+	Until     *time.Time `json:"until,omitempty"`
+}
+
+// eventSink delivers encoded event to external target.
+type eventSink interface {
+	// Name returns sink name used in logs and metrics
+	Name() string
+	// Send delivers event, errors wrapping errEventRejected are not retried
+	Send(ctx context.Context, e event, b []byte) error
+}
+
+// webhookSink posts events as JSON to HTTP endpoint.
+type webhookSink struct {
+	url    string
+	client *http.Client
+}
+
+// datagramSink sends events as JSON datagrams to unix socket.
+type datagramSink struct {
+	conn *datagramConn
+}
+
+// syslogSink sends events as JSON in RFC 5424 messages to local syslog socket.
+type syslogSink struct {
+	w *syslogWriter
+}
+
+// eventQueue buffers events of one sink.
+type eventQueue struct {
+	sink  eventSink
+	queue chan event
+
+	// dropped counts events dropped since queue became full, warning is logged once until queue drains
+	dropped atomic.Int64
+}
+
+// eventDispatcher queues events per sink and delivers them asynchronously with bounded retries.
+type eventDispatcher struct {
+	mu      sync.RWMutex
+	closed  bool
+	wg      sync.WaitGroup
+	types   map[string]bool
+	retries int
+	timeout time.Duration
+	queues  []*eventQueue
+}
+
+// errEventRejected marks event delivery error that must not be retried.
+var errEventRejected = errors.New("event rejected")
+
+func (s *webhookSink) Name() string {
+	u, err := url.Parse(s.url)
+	if err != nil {
+		return "webhook"
+	}
+
+	// credentials in URL are not exposed
+	return "webhook:" + u.Host
+}
+
+func (s *webhookSink) Send(ctx context.Context, _ event, b []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("%w: %w", errEventRejected, err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+		return nil
+	case resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("webhook error: %s", resp.Status)
+	default:
+		return fmt.Errorf("%w: webhook error: %s", errEventRejected, resp.Status)
+	}
+}
+
+func (s *datagramSink) Name() string {
+	return "unixgram:" + s.conn.path
+}
+
+func (s *datagramSink) Send(ctx context.Context, _ event, b []byte) error {
+	return s.conn.Send(ctx, b)
+}
+
+func (s *syslogSink) Name() string {
+	return "syslog:" + s.w.Path()
+}
+
+func (s *syslogSink) Send(ctx context.Context, e event, b []byte) error {
+	return s.w.Write(ctx, syslogFacilityLocal0, getEventSeverity(e.Type), "", e.Type, b)
+}
+
+// getEventSeverity returns syslog severity of event type.
+func getEventSeverity(eventType string) int {
+	switch eventType {
+	case eventBanned:
+		return syslogSeverityWarning
+	case eventChallengeFailed, eventChallengeExpired:
+		return syslogSeverityNotice
+	default:
+		return syslogSeverityInfo
+	}
+}
+
+// parseEventSink creates sink from target, "http(s)://URL", "unixgram:PATH" or "syslog:[PATH]".
+func parseEventSink(target string, timeout time.Duration) (eventSink, error) {
+	switch {
+	case strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://"):
+		if _, err := url.ParseRequestURI(target); err != nil {
+			return nil, fmt.Errorf("event sink error: %w", err)
+		}
+
+		return &webhookSink{url: target, client: &http.Client{Timeout: timeout}}, nil
+	case strings.HasPrefix(target, "unixgram:") && target != "unixgram:":
+		return &datagramSink{conn: &datagramConn{path: strings.TrimPrefix(target, "unixgram:")}}, nil
+	case strings.HasPrefix(target, "syslog:"):
+		return &syslogSink{w: newSyslogWriter(strings.TrimPrefix(target, "syslog:"))}, nil
+	default:
+		return nil, fmt.Errorf("event sink error: unknown target '%s'", target)
+	}
+}
+
+// redactEventSinks returns sink targets with webhook URL path, query and credentials removed.
+func redactEventSinks(targets string) string {
+	out := make([]string, 0)
+
+	for _, target := range strings.Split(targets, ",") {
+		target = strings.TrimSpace(target)
+		if target == "" {
+			continue
+		}
+
+		if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+			u, err := url.Parse(target)
+			if err != nil {
+				target = "REDACTED"
+			} else {
+				target = u.Scheme + "://" + u.Host + "/REDACTED"
+			}
+		}
+
+		out = append(out, target)
+	}
+
+	return strings.Join(out, ",")
+}
+
+// parseEventTypes parses comma separated event types, empty list selects all types.
+func parseEventTypes(s string) (map[string]bool, error) {
+	all := []string{eventChallengeIssued, eventChallengeSolved, eventChallengeFailed, eventChallengeExpired, eventBanned}
+	types := make(map[string]bool, len(all))
+
+	if strings.TrimSpace(s) == "" {
+		for _, t := range all {
+			types[t] = true
+		}
+
+		return types, nil
+	}
+
+	for _, t := range strings.Split(s, ",") {
+		t = strings.TrimSpace(t)
+
+		known := false
+
+		for _, k := range all {
+			known = known || k == t
+		}
+
+		if !known {
+			return nil, fmt.Errorf("event sink error: unknown event type '%s'", t)
+		}
+
+		types[t] = true
+	}
+
+	return types, nil
+}
+
+// newEventDispatcher creates dispatcher for comma separated sink targets and event types.
+func newEventDispatcher(targets, types string, size, retries uint, timeout time.Duration) (*eventDispatcher, error) {
+	selected, err := parseEventTypes(types)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &eventDispatcher{
+		types:   selected,
+		retries: int(retries),
+		timeout: timeout,
+	}
+
+	for _, target := range strings.Split(targets, ",") {
+		target = strings.TrimSpace(target)
+		if target == "" {
+			continue
+		}
+
+		sink, err := parseEventSink(target, timeout)
+		if err != nil {
+			return nil, err
+		}
+
+		d.queues = append(d.queues, &eventQueue{sink: sink, queue: make(chan event, size)})
+	}
+
+	return d, nil
+}
+
+// Start runs delivery worker per sink.
+func (d *eventDispatcher) Start() {
+	for _, q := range d.queues {
+		d.wg.Add(1)
+
+		go d.run(q)
+	}
+}
+
+// Emit queues event to every sink, event is dropped when sink queue is full,
+// full queue is logged once until it drains.
+func (d *eventDispatcher) Emit(e event) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.closed || !d.types[e.Type] {
+		return
+	}
+
+	for _, q := range d.queues {
+		select {
+		case q.queue <- e:
+		default:
+			metricEvents.Inc(q.sink.Name(), "dropped")
+
+			if q.dropped.Add(1) == 1 {
+				logMessage(
+					slog.LevelWarn, messageEventDropped,
+					"sink", q.sink.Name(),
+					"type", e.Type,
+				)
+			}
+		}
+	}
+}
+
+// run delivers queued events of sink until queue is closed.
+func (d *eventDispatcher) run(q *eventQueue) {
+	defer d.wg.Done()
+
+	for e := range q.queue {
+		// queue drained after events were dropped
+		if len(q.queue) == 0 {
+			if dropped := q.dropped.Swap(0); dropped > 0 {
+				logMessage(
+					slog.LevelInfo, messageEventDrained,
+					"sink", q.sink.Name(),
+					"dropped", dropped,
+				)
+			}
+		}
+
+		b, err := json.Marshal(e)
+		if err != nil {
+			continue
+		}
+
+		err = d.deliver(q.sink, e, b)
+		if err != nil {
+			metricEvents.Inc(q.sink.Name(), "failed")
+
+			logMessage(
+				slog.LevelWarn, messageEventFailed,
+				"sink", q.sink.Name(),
+				"type", e.Type,
+				"error", err.Error(),
+			)
+
+			continue
+		}
+
+		metricEvents.Inc(q.sink.Name(), "sent")
+	}
+}
+
+// deliver sends event with exponential backoff between retries.
+func (d *eventDispatcher) deliver(sink eventSink, e event, b []byte) error {
+	var err error
+
+	for attempt := 0; attempt <= d.retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(eventRetryBackoff << (attempt - 1))
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+		err = sink.Send(ctx, e, b)
+		cancel()
+
+		if err == nil || errors.Is(err, errEventRejected) {
+			return err
+		}
+	}
+
+	return err
+}
+
+// Close stops accepting events and waits until queued events are delivered or ctx is done.
+func (d *eventDispatcher) Close(ctx context.Context) error {
+	d.mu.Lock()
+
+	if !d.closed {
+		d.closed = true
+
+		for _, q := range d.queues {
+			close(q.queue)
+		}
+	}
+
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("event sink error: %w", ctx.Err())
+	}
+}
+
+// emitEvent sends event to event sinks without blocking, address and UA follow log privacy mode.
+func emitEvent(e event) {
+	if events == nil {
+		return
+	}
+
+	e.Time = time.Now()
+	e.Address = anonymizeAddress(e.Address)
+	e.UserAgent = anonymizeUserAgent(e.UserAgent)
+
+	// ban key is address or network prefix, prefixes are already anonymous
+	if !strings.Contains(e.Ban, "/") {
+		e.Ban = anonymizeAddress(e.Ban)
+	}
+
+	events.Emit(e)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"log/slog"
 	"net/http"
 	"sync"
 	"time"
@@ -19,19 +20,36 @@ func cleanDB(db *sync.Map) {
 				if record, ok := val.(captchaDBRecord); ok {
 					// check expiration time
 					if record.Expires.Before(time.Now()) {
-						Debug.Printf(
-							"%d, Domain:'%s', ID:'%s', %s\n",
-							http.StatusOK, record.Domain,
-							id, messageExpiredRecord,
+						logMessage(
+							slog.LevelDebug, messageExpiredRecord,
+							"status", http.StatusOK,
+							"domain", record.Domain,
+							"id", id,
 						)
 
 						// check then id is NOT UUID
 						if !reUUID.MatchString(id) {
-							Bot.Printf(
-								"%d, Domain:'%s', Addr:'%s', UA:'%s'\n",
-								http.StatusTeapot, record.Domain,
-								record.Address, record.UserAgent,
+							logBot(
+								http.StatusTeapot, messageUnsolvedExpired,
+								"domain", record.Domain,
+								"remote_addr", record.Address,
+								"ua", record.UserAgent,
 							)
+
+							emitEvent(event{
+								Type:      eventChallengeExpired,
+								Domain:    record.Domain,
+								Address:   record.Address,
+								UserAgent: record.UserAgent,
+								Challenge: record.Type,
+								Reason:    messageUnsolvedExpired,
+							})
+
+							// every page has image challenge, lineage is stored server side,
+							// so challenges of a single client are counted once per ban window
+							if record.Type == challengeTypeImage {
+								bans.FailUnsolved(record.BanKey, record.Lineage, messageUnsolvedExpired)
+							}
 						}
 
 						// delete key
@@ -44,3 +62,43 @@ func cleanDB(db *sync.Map) {
 		})
 	}
 }
+
+func cleanFailures(c *failureCounter) {
+	for {
+		// sleep inside infinite loop
+		time.Sleep(15 * time.Second)
+
+		// remove counters past cooldown
+		c.Clean()
+	}
+}
+
+func cleanCrawlers(v *crawlerVerifier) {
+	for {
+		// sleep inside infinite loop
+		time.Sleep(15 * time.Second)
+
+		// remove expired verdicts
+		v.Clean()
+	}
+}
+
+func cleanOffenders(t *offenderTracker) {
+	for {
+		// sleep inside infinite loop
+		time.Sleep(15 * time.Second)
+
+		// remove addresses without recent Bot events
+		t.Clean()
+	}
+}
+
+func cleanBans(b *banList) {
+	for {
+		// sleep inside infinite loop
+		time.Sleep(15 * time.Second)
+
+		// remove expired bans and counters
+		b.Clean()
+	}
+}
@@ -1,36 +1,200 @@
 package main
 
 import (
-	"html/template"
-	"log"
+	"log/slog"
 	"net/http"
 	"regexp"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	captcha "github.com/s3rj1k/go-captcha"
 )
 
 const (
 	// defines case-insensitive list of captcha characters.
 	defaultCharsList = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 
+	// captcha text length of pregenerated captcha
+	defaultCaptchaLength = 6
+	// captcha noise density of pregenerated captcha
+	defaultNoiseDensity = 0.05
+	// maximal difficulty level, each level adds one character and noise
+	maxDifficultyLevel = 3
+
 	// authentication cookie name
 	authenticationName = "t6f6e7r83mv6g8mzr4m739k6p"
 	// number of seconds for authentication cookie expiration
 	authenticationExpirationSeconds = 86400
 
 	// captcha form input names
-	challengeKey = "captcha_challenge"
-	responseKey  = "captcha_response"
-	imageID      = "captcha_image"
+	challengeKey  = "captcha_challenge"
+	responseKey   = "captcha_response"
+	trajectoryKey = "captcha_trajectory"
+	imageID       = "captcha_image"
 
 	// number of seconds for challenge hash expiration
 	challengeExpirationSeconds = 60
 
+	// challenge types
+	challengeTypeImage  = "image"
+	challengeTypeJS     = "js"
+	challengeTypeSlider = "slider"
+
+	// event types
+	eventChallengeIssued  = "challenge_issued"
+	eventChallengeSolved  = "challenge_solved"
+	eventChallengeFailed  = "challenge_failed"
+	eventChallengeExpired = "challenge_expired"
+	eventBanned           = "banned"
+
+	// syslog facility and severities
+	syslogFacilityLocal0  = 16
+	syslogSeverityError   = 3
+	syslogSeverityWarning = 4
+	syslogSeverityNotice  = 5
+	syslogSeverityInfo    = 6
+	syslogSeverityDebug   = 7
+
+	// policy cookie scopes
+	cookieScopeHost       = "host"
+	cookieScopeTLDPlusOne = "tldplusone"
+
+	// policy templates
+	templateFull = "full"
+	templateLite = "lite"
+
+	// privacy modes of addresses and UAs
+	privacyModeNone     = "none"
+	privacyModeTruncate = "truncate"
+	privacyModeHash     = "hash"
+	privacyModeOmit     = "omit"
+
+	// retention modes of address and UA in db records
+	privacyRecordsFull       = "full"
+	privacyRecordsAnonymized = "anonymized"
+	privacyRecordsMinimal    = "minimal"
+
+	// network prefix length kept by address truncation
+	privacyPrefixBitsIPv4 = 24
+	privacyPrefixBitsIPv6 = 48
+
+	// log output formats
+	logFormatJSON   = "json"
+	logFormatLogfmt = "logfmt"
+
+	// log outputs, syslog and journald accept optional ":PATH" socket suffix
+	logOutputStdout   = "stdout"
+	logOutputSyslog   = "syslog"
+	logOutputJournald = "journald"
+
+	// default admin listener address of ctl subcommand
+	defaultCtlAddress = "unix:/run/nginx-captcha-admin.sock"
+	// prefix of configuration environment variables
+	configEnvPrefix = "NGINX_CAPTCHA_"
+
+	// session, widget token and SSO nonce record types
+	recordTypeSession     = "session"
+	recordTypeWidgetToken = "widget-token"
+	recordTypeSSONonce    = "sso-nonce"
+
+	// number of seconds for widget token expiration
+	widgetTokenExpirationSeconds = 120
+
+	// timeout of nginx reload command after deny list update
+	denyReloadTimeout = 30 * time.Second
+
+	// timeout of DNS lookups for crawler verification
+	crawlerLookupTimeout = 2 * time.Second
+	// maximal number of cached crawler verification verdicts
+	crawlerVerdictLimit = 10000
+
+	// db key prefix of readiness check probe values, never UUID or challenge hash
+	readinessProbeKey = "readiness-probe-"
+
+	// first delay between event delivery retries, doubled on each retry
+	eventRetryBackoff = 500 * time.Millisecond
+
+	// default local syslog socket
+	defaultSyslogPath = "/dev/log"
+	// RFC 5424 timestamp layout, TIME-SECFRAC has at most 6 digits
+	syslogTimeLayout = "2006-01-02T15:04:05.000000Z07:00"
+	// default systemd journal native protocol socket
+	defaultJournaldPath = "/run/systemd/journal/socket"
+
+	// domain label of hosts over distinct domain label limit
+	metricDomainOther = "other"
+	// number of distinct domain labels, requested host is client controlled
+	metricDomainLimit = 100
+
+	// OTLP span kind and status codes
+	otlpSpanKindServer = 2
+	otlpStatusError    = 2
+	// instrumentation scope of exported spans
+	traceScopeName = "github.com/s3rj1k/go-nginx-captcha"
+	// number of queued spans, spans are dropped when queue is full
+	traceQueueSize = 2048
+	// maximal number of spans in single export request
+	traceBatchSize = 512
+	// interval of span export
+	traceExportInterval = 5 * time.Second
+	// timeout of span export request
+	traceExportTimeout = 10 * time.Second
+
+	// interval of dashboard server-sent events
+	dashboardInterval = 2 * time.Second
+	// number of top offending addresses shown on dashboard
+	dashboardTopOffenders = 10
+	// duration offending address is tracked after its last Bot event
+	offenderWindow = time.Hour
+	// maximal number of tracked offending addresses
+	offenderLimit = 10000
+
+	// number of operations in JS browser-check computation
+	jsCheckOperations = 12
+	// minimal number of milliseconds before JS browser-check submits result
+	jsCheckDelayMilliseconds = 1500
+
+	// slider puzzle piece size in pixels
+	sliderPieceSize = 40
+	// allowed difference between slider puzzle solution and response in pixels
+	sliderTolerancePixels = 4
+	// limits of slider movement trajectory points
+	sliderMinTrajectoryPoints = 5
+	sliderMaxTrajectoryPoints = 1000
+	// minimal duration of slider movement in milliseconds
+	sliderMinMovementMilliseconds = 200
+
+	// challenge lineage cookie name
+	lineageName = "m3k8r5t2w9p4f7n1x6c3b8q5z"
+
+	// SSO endpoints
+	ssoStartPath   = "/captcha-sso/start"
+	ssoConsumePath = "/captcha-sso/consume"
+	// number of seconds for SSO assertion expiration
+	ssoAssertionExpirationSeconds = 30
+	// failed SSO handshake cookie name, forces local captcha
+	ssoFailedName = "s8d2f6g4h9j3k7l1z5x8c2v6b"
+
+	// JS browser-check fallback cookie name, forces image captcha
+	fallbackName = "c5n8w2k7x4q9d3m6b1v8z5j2h"
+	// number of seconds for JS browser-check fallback cookie expiration
+	fallbackExpirationSeconds = 300
+
 	// number of nanoseconds in second
 	nanoSecondsInSecond = 1000000000
 
 	// HTTP code for non-authorized request, used in nginx redirects
 	unAuthorizedAccess = http.StatusUnauthorized
+	// HTTP code for banned request, nginx passes it to client as is
+	bannedAccess = http.StatusForbidden
+
+	// network prefix length used to count failures of neighbouring addresses
+	banPrefixBitsIPv4 = 24
+	banPrefixBitsIPv6 = 64
+
+	// maximal size of JSON request body
+	maxJSONBodyBytes = 1 << 16
 
 	// regex for UUIDv4 validation
 	regExpUUIDv4 = `^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-4[0-9a-fA-F]{3}-[8,9,a,b][0-9a-fA-F]{3}-[0-9a-fA-F]{12}$`
@@ -41,14 +205,20 @@ const (
 	messageOnlyGetOrPostMethod = "only GET or POST method"
 	messageOnlyPostMethod      = "only POST method"
 
-	messageFailedEntropy = "entropy failure"
+	messageFailedEntropy   = "entropy failure"
+	messageFailedChallenge = "challenge generation failure"
 
 	messageFailedHTMLRender   = "HTML render failure"
 	messageFailedHTTPResponse = "HTTP response failure"
 
 	messageExpiredChallenge = "expired challenge"
 	messageInvalidChallenge = "invalid challenge"
+	messageInvalidRequest   = "invalid request"
 	messageInvalidResponse  = "invalid response"
+	messageTooFastResponse  = "too fast response"
+	messageFilledHoneypot   = "filled honeypot"
+	messageUnsolvedExpired  = "unsolved challenge expired"
+	messageBanned           = "temporarily banned"
 
 	messageExpiredRecord    = "expired record"
 	messageUnknownChallenge = "unknown challenge"
@@ -57,50 +227,277 @@ const (
 	messageExpiredAuthentication       = "authentication expired"
 	messageInvalidAuthenticationDomain = "invalid authentication domain"
 	messageInvalidUserAgent            = "invalid authentication user-agent"
+	messageInvalidAddress              = "invalid authentication address"
+	messageUnverifiedCrawler           = "unverified crawler user-agent"
 	messageUnknownAuthentication       = "unknown authentication"
 	messageValidAuthentication         = "valid authentication"
 
 	messageAllowOptionsRequest = "allow OPTIONS method"
 	messageAllowWebFont        = "allow web font"
+	messageAllowExemptPath     = "allow exempt path"
+	messageAllowListed         = "allow listed request"
+	messageAllowCrawler        = "allow verified crawler"
+
+	messageSiteverify = "site verification"
+
+	messageSSODisabled         = "SSO disabled"
+	messageSSORedirect         = "SSO redirect"
+	messageSSOAssertion        = "SSO assertion issued"
+	messageSSOSession          = "SSO session"
+	messageInvalidSSOAssertion = "invalid SSO assertion"
+	messageForbiddenSSODomain  = "SSO domain not allowed"
+
+	messageIssuedChallenge   = "challenge issued"
+	messageValidationRequest = "validation request"
+	messageSolvedChallenge   = "challenge solved"
+	messageSolveTimes        = "solve time distribution"
+	messageActiveBan         = "active ban"
+
+	messageAdminTokenRequired = "admin token required on TCP listener"
+	messageAdminUnauthorized  = "invalid admin token"
+	messageAdminEmptyFilter   = "empty filter"
+	messageAdminUnknownBan    = "unknown ban"
+	messageAdminSession       = "admin session issued"
+	messageAdminRevoke        = "admin session revoked"
+	messageAdminLiftBan       = "admin ban lifted"
+	messageAdminReload        = "admin reload"
+
+	messageEventDropped = "event queue full"
+	messageEventDrained = "event queue drained"
+	messageEventFailed  = "event delivery failure"
+
+	messageSpanDropped      = "span queue full"
+	messageSpanExportFailed = "span export failure"
+
+	messageCrawlerLookupFailed = "crawler lookup failure"
+
+	messageShuttingDown   = "shutting down"
+	messageShutdown       = "shutdown complete"
+	messageShutdownFailed = "graceful shutdown failure"
+
+	messageLogLevel             = "log level changed"
+	messageReloaded             = "file reloaded"
+	messageReloadFailed         = "file reload failure"
+	messageDenyListWritten      = "deny list written"
+	messageDenyListFailed       = "deny list write failure"
+	messageDenyListReloadFailed = "deny list reload failure"
+	messageGenerateFailed       = "captcha generation failure"
+	messageStartFailed          = "captcha service start failure"
+	messageListenFailed         = "captcha service listen failure"
+	messageServeFailed          = "captcha service serve failure"
 )
 
 type captchaDBRecord struct {
+	// Type defines challenge type or session record type
+	Type string
+	// Solution stores hash of expected challenge response
+	Solution string
+	// Sibling stores alternative challenge issued on the same page
+	Sibling string
+	// Offset stores slider puzzle solution
+	Offset int
+	// Lineage links consecutive challenges of a single client
+	Lineage string
+	// Honeypots stores names of form inputs that must stay empty
+	Honeypots []string
+
 	// Domain defines valid captcha domain
 	Domain string
 	// UserAgent stores UA that originated from HTTP request
 	UserAgent string
+	// Issued defines time when record was created
+	Issued time.Time
 	// Expires defines captcha TTL
 	Expires time.Time
 
 	// Address stores address that originated from HTTP request
 	Address string
+	// BanKey stores address or network prefix that unsolved challenge counts towards, it is never logged
+	BanKey string
+
+	// URI stores local URI where client is returned after solved challenge
+	URI string
 }
 
 var (
-	// captcha HTML template
-	captchaHTMLTemplate *template.Template
-	// captcha Lite HTML template
-	captchaLiteTemplate *template.Template
+	// HTML templates
+	templates atomic.Pointer[templateSet]
 
 	// in memory key:value database
 	db sync.Map
 
 	// in memory captcha database
-	captchaDB Data
+	captchaDB atomic.Pointer[Data]
+	// in memory captcha database load state
+	captchaDBState atomic.Pointer[captchaDBStatus]
+	// CAPTCHA generation profiles for escalated difficulty levels
+	escalatedOptions []*captcha.Options
+
+	// failure counters per client address and challenge lineage
+	failures *failureCounter
+
+	// solve time distributions per challenge type
+	solveTimes *histogramVec
+
+	// Prometheus metrics
+	metricChallengesIssued *counterVec
+	metricValidations      *counterVec
+	metricAuthDecisions    *counterVec
+	metricHandlerDuration  *histogramVec
+	metricEvents           *counterVec
+	metricDomains          *metricDomainSet
+
+	// event sinks, nil when events are disabled
+	events *eventDispatcher
+
+	// span exporter, nil when tracing is disabled
+	tracer *spanExporter
+
+	// widget site secrets per domain
+	siteSecrets atomic.Pointer[map[string]string]
+
+	// HMAC key for SSO assertions
+	ssoSecret []byte
+	// domains allowed to take part in SSO
+	ssoDomains map[string]bool
+
+	// active per-domain policies
+	policies atomic.Pointer[policySet]
+	// active allowlist
+	allowed atomic.Pointer[allowlist]
+
+	// temporary bans of repeated offenders
+	bans *banList
+
+	// crawler verifier, nil when crawler verification is disabled
+	crawlers *crawlerVerifier
+
+	// Bot event counters per client address
+	offenders *offenderTracker
+
+	// set when graceful shutdown starts
+	shuttingDown atomic.Bool
+
+	// counter of readiness probes, each probe uses own db key
+	readinessProbes atomic.Uint64
 
 	// compiled RegExp for UUIDv4
 	reUUID *regexp.Regexp
 
+	// path to config file
+	cmdConfigPath string
+	// validate and print configuration
+	cmdCheckConfig bool
 	// IP:PORT or unix socket path
 	cmdAddress string
 	// log date/time
 	cmdLogDateTime bool
 	// enable debug logging
 	cmdDebug bool
+	// log output format
+	cmdLogFormat string
+	// log output, stdout, syslog or journald
+	cmdLogOutput string
+	// syslog facility of log records
+	cmdLogFacility string
+	// syslog tag of log records
+	cmdLogTag string
+	// syslog facility of Bot log records
+	cmdLogBotFacility string
+	// syslog tag of Bot log records
+	cmdLogBotTag string
+	// address privacy mode
+	cmdPrivacyAddress string
+	// UA privacy mode
+	cmdPrivacyUserAgent string
+	// redact cookie IDs, tokens and responses in logs
+	cmdPrivacyRedact bool
+	// db record retention mode
+	cmdPrivacyRecords string
+	// path to keyed hashing key file
+	cmdPrivacyKeyPath string
+	// minimal log level
+	cmdLogLevel string
+	// number of events logged each second before sampling
+	cmdLogSampleInitial uint
+	// log every Nth event after initial events
+	cmdLogSampleThereafter uint
 	// generates CAPTCHA to a file DB
 	cmdGenerate uint
 	// path to CAPTCHA DB file
 	cmdDBPath string
+	// number of failures that raise difficulty level, zero disables escalation
+	cmdEscalateAfter uint
+	// duration after last failure when difficulty is reset
+	cmdEscalateCooldown time.Duration
+	// minimal duration between challenge render and response
+	cmdMinSolveTime time.Duration
+	// challenge type of domains without policy challenge type
+	cmdChallengeType string
+	// path to widget site secrets file
+	cmdSiteSecretsPath string
+	// central SSO captcha domain
+	cmdSSODomain string
+	// comma separated list of domains allowed to take part in SSO
+	cmdSSODomains string
+	// path to SSO assertion HMAC key file
+	cmdSSOSecretPath string
+	// path to HTML template overrides directory
+	cmdTemplatesDir string
+	// path to per-domain policy file
+	cmdPolicyPath string
+	// path to allowlist file
+	cmdAllowlistPath string
+	// admin listener IP:PORT or unix socket path
+	cmdAdminAddress string
+	// path to admin API bearer token file
+	cmdAdminTokenPath string
+	// comma separated event sink targets
+	cmdEventSinks string
+	// comma separated event types
+	cmdEventTypes string
+	// number of queued events per sink
+	cmdEventQueue uint
+	// number of event delivery retries
+	cmdEventRetries uint
+	// event delivery timeout
+	cmdEventTimeout time.Duration
+	// OTLP/HTTP traces endpoint
+	cmdTraceEndpoint string
+	// path to OTLP export request headers file
+	cmdTraceHeadersPath string
+	// service name of exported spans
+	cmdTraceServiceName string
+	// sampling ratio of requests without incoming trace context
+	cmdTraceSampleRatio float64
+	// duration service reports not ready before shutdown
+	cmdShutdownDelay time.Duration
+	// maximal duration of waiting for in-flight requests on shutdown
+	cmdShutdownTimeout time.Duration
+	// number of failures within window that ban address, zero disables ban
+	cmdBanAfter uint
+	// number of failures within window that ban network prefix, zero disables ban
+	cmdBanPrefixAfter uint
+	// duration failures are counted for bans
+	cmdBanWindow time.Duration
+	// ban duration
+	cmdBanDuration time.Duration
+	// path to nginx deny list include file
+	cmdDenyFile string
+	// command that reloads nginx after deny list update
+	cmdDenyReloadCommand string
+	// deny list update interval
+	cmdDenyInterval time.Duration
+	// number of Bot events that add address to deny list, zero disables Bot event entries
+	cmdDenyBotAfter uint
+	// duration since last Bot event that address stays in deny list
+	cmdDenyBotWindow time.Duration
+	// confirm search engine crawlers with reverse DNS
+	cmdCrawlerVerify bool
+	// DNS server IP:PORT for crawler verification
+	cmdCrawlerResolver string
+	// crawler verification verdict TTL
+	cmdCrawlerCacheTTL time.Duration
 
 	// empty favicon.ico
 	favicon = []byte{
@@ -131,9 +528,13 @@ var (
 		000, 000, 255, 255, 000, 000,
 	}
 
-	// Logging levels
-	Info  *log.Logger
-	Error *log.Logger
-	Debug *log.Logger
-	Bot   *log.Logger
+	// admin API bearer token
+	adminToken []byte
+
+	// keyed hashing key for anonymized values
+	privacyKey []byte
+
+	// structured logger and its runtime level
+	logger   *slog.Logger
+	logLevel slog.LevelVar
 )
@@ -53,45 +53,103 @@ func readCaptchaDB(path string) (Data, error) {
 	return data, nil
 }
 
-// generateCapcthaDB generates CAPTCHA and save them to a gob encoded file.
-func generateCapcthaDB(path string, n uint) error {
-	data := Data{
-		Map:  make(map[string]string),
-		Keys: []string{},
+// captchaDBStatus defines state of active CAPTCHA db and its last load.
+type captchaDBStatus struct {
+	Path   string    `json:"path"`
+	Size   int       `json:"size"`
+	Loaded time.Time `json:"loaded"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// loadCaptchaDB reads CAPTCHA db and replaces active db, previous db stays active on error.
+func loadCaptchaDB(path string) error {
+	data, err := readCaptchaDB(path)
+	if err == nil && (len(data.Keys) == 0 || len(data.Keys) != len(data.Map)) {
+		err = fmt.Errorf("captcha db error: empty or inconsistent db")
+	}
+
+	if err != nil {
+		// keep status of active db, record failure
+		status := captchaDBStatus{Path: path}
+		if prev := captchaDBState.Load(); prev != nil {
+			status = *prev
+		}
+
+		status.Error = err.Error()
+		captchaDBState.Store(&status)
+
+		return err
 	}
 
+	captchaDB.Store(&data)
+	captchaDBState.Store(&captchaDBStatus{
+		Path:   path,
+		Size:   len(data.Keys),
+		Loaded: time.Now(),
+	})
+
+	return nil
+}
+
+// newCaptchaOptions creates CAPTCHA generation profile with specified text length and noise density.
+func newCaptchaOptions(length int, noise float64) (*captcha.Options, error) {
 	captchaConfig, err := captcha.NewOptions()
 	if err != nil {
-		return fmt.Errorf("captcha generate error: %w", err)
+		return nil, fmt.Errorf("captcha generate error: %w", err)
 	}
 
 	if err = captchaConfig.SetCharacterList(defaultCharsList); err != nil {
-		return fmt.Errorf("captcha generate error: %w", err)
+		return nil, fmt.Errorf("captcha generate error: %w", err)
 	}
 
-	if err = captchaConfig.SetCaptchaTextLength(6); err != nil {
-		return fmt.Errorf("captcha generate error: %w", err)
+	if err = captchaConfig.SetCaptchaTextLength(length); err != nil {
+		return nil, fmt.Errorf("captcha generate error: %w", err)
 	}
 
 	if err = captchaConfig.SetDimensions(320, 100); err != nil {
-		return fmt.Errorf("captcha generate error: %w", err)
+		return nil, fmt.Errorf("captcha generate error: %w", err)
 	}
 
-	f := func() error {
-		var captchaObj *captcha.Captcha
+	captchaConfig.SetNoiseDensity(noise, noise, noise)
 
-		captchaObj, err = captchaConfig.CreateImage()
-		if err != nil {
-			return fmt.Errorf("captcha generate error: %w", err)
-		}
+	return captchaConfig, nil
+}
+
+// createCaptcha creates CAPTCHA and returns text hash with base64 encoded JPEG.
+func createCaptcha(captchaConfig *captcha.Options) (key string, value string, err error) {
+	captchaObj, err := captchaConfig.CreateImage()
+	if err != nil {
+		return "", "", fmt.Errorf("captcha generate error: %w", err)
+	}
 
-		var buff bytes.Buffer
+	var buff bytes.Buffer
 
-		if err = jpeg.Encode(&buff, captchaObj.Image, nil); err != nil {
-			return fmt.Errorf("captcha generate error: %w", err)
+	if err = jpeg.Encode(&buff, captchaObj.Image, nil); err != nil {
+		return "", "", fmt.Errorf("captcha generate error: %w", err)
+	}
+
+	return getStringHash(captchaObj.Text), base64.StdEncoding.EncodeToString(buff.Bytes()), nil
+}
+
+// generateCapcthaDB generates CAPTCHA and save them to a gob encoded file.
+func generateCapcthaDB(path string, n uint) error {
+	data := Data{
+		Map:  make(map[string]string),
+		Keys: []string{},
+	}
+
+	captchaConfig, err := newCaptchaOptions(defaultCaptchaLength, defaultNoiseDensity)
+	if err != nil {
+		return err
+	}
+
+	f := func() error {
+		key, value, err := createCaptcha(captchaConfig)
+		if err != nil {
+			return err
 		}
 
-		data.Map[getStringHash(captchaObj.Text)] = base64.StdEncoding.EncodeToString(buff.Bytes())
+		data.Map[key] = value
 
 		return nil
 	}
@@ -2,58 +2,37 @@ package main
 
 import (
 	"errors"
+	"html/template"
+	"log/slog"
 	"net/http"
 	"strings"
 	"syscall"
 	"time"
-
-	"golang.org/x/net/publicsuffix"
 )
 
 func faviconHandler(w http.ResponseWriter, r *http.Request) {
 	if _, err := w.Write(favicon); err != nil {
-		Error.Printf(
-			"%d, RAddr:'%s', URL:'%s%s', UA:'%s', %s\n",
-			http.StatusInternalServerError,
-			r.Header.Get("X-Real-IP"),
-			r.Header.Get("X-Forwarded-Host"),
-			r.Header.Get("X-Original-URI"),
-			r.UserAgent(), messageFailedHTTPResponse,
-		)
+		logEvent(slog.LevelError, r, http.StatusInternalServerError, messageFailedHTTPResponse)
 	}
 }
 
 func challengeHandle(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
-		renderHandle(w, r)
+		traceHandler("render", renderHandle)(w, r)
 	case http.MethodPost:
-		validateHandle(w, r)
+		traceHandler("validate", validateHandle)(w, r)
 	case http.MethodOptions:
 		// OPTIONS is needed for CORS to function properly, we allow all OPTIONS requests when specific header is passed
 		if strings.EqualFold(r.Header.Get("X-Allow-OPTIONS"), "TRUE") {
-			Debug.Printf(
-				"%d, RAddr:'%s', URL:'%s%s', UA:'%s', %s\n",
-				http.StatusAccepted,
-				r.Header.Get("X-Real-IP"),
-				r.Header.Get("X-Forwarded-Host"),
-				r.Header.Get("X-Original-URI"),
-				r.UserAgent(), messageAllowOptionsRequest,
-			)
+			logEvent(slog.LevelDebug, r, http.StatusAccepted, messageAllowOptionsRequest)
 
 			return
 		}
 
 		fallthrough
 	default:
-		Debug.Printf(
-			"%d, RAddr:'%s', URL:'%s%s', UA:'%s', %s\n",
-			http.StatusMethodNotAllowed,
-			r.Header.Get("X-Real-IP"),
-			r.Header.Get("X-Forwarded-Host"),
-			r.Header.Get("X-Original-URI"),
-			r.UserAgent(), messageOnlyGetOrPostMethod,
-		)
+		logEvent(slog.LevelDebug, r, http.StatusMethodNotAllowed, messageOnlyGetOrPostMethod)
 
 		// set default allowed headers
 		allowHeader := []string{
@@ -72,7 +51,7 @@ func challengeHandle(w http.ResponseWriter, r *http.Request) {
 			strings.Join(allowHeader, ", "),
 		)
 
-		http.Error(w, messageOnlyGetOrPostMethod, http.StatusMethodNotAllowed)
+		httpError(w, r, messageOnlyGetOrPostMethod, http.StatusMethodNotAllowed)
 
 		return
 	}
@@ -81,32 +60,23 @@ func challengeHandle(w http.ResponseWriter, r *http.Request) {
 func renderHandle(w http.ResponseWriter, r *http.Request) {
 	// allow only GET method
 	if r.Method != http.MethodGet {
-		Debug.Printf(
-			"%d, RAddr:'%s', URL:'%s%s', UA:'%s', %s\n",
-			http.StatusMethodNotAllowed,
-			r.Header.Get("X-Real-IP"),
-			r.Header.Get("X-Forwarded-Host"),
-			r.Header.Get("X-Original-URI"),
-			r.UserAgent(), messageOnlyGetMethod,
-		)
+		logEvent(slog.LevelDebug, r, http.StatusMethodNotAllowed, messageOnlyGetMethod)
 
 		// return proper HTTP error with headers
 		w.Header().Set("Allow", http.MethodGet)
-		http.Error(w, messageOnlyGetMethod, http.StatusMethodNotAllowed)
+		httpError(w, r, messageOnlyGetMethod, http.StatusMethodNotAllowed)
 
 		return
 	}
 
-	// define domain for a cookie
-	domain := r.Header.Get("X-Forwarded-Host")
-
-	// compute wildcard domain cookie when appropriate configuration header present
-	if strings.EqualFold(r.Header.Get("X-TLDPlusOne"), "TRUE") {
-		if val, err := publicsuffix.EffectiveTLDPlusOne(r.Header.Get("X-Forwarded-Host")); err == nil {
-			domain = "." + val
-		}
+	// reject banned address
+	if rejectBanned(w, r) {
+		return
 	}
 
+	// define domain for a cookie
+	domain := getCookieDomain(r.Header)
+
 	// clean old invalid cookies
 	http.SetCookie(w, &http.Cookie{
 		Domain:  domain,
@@ -121,39 +91,120 @@ func renderHandle(w http.ResponseWriter, r *http.Request) {
 	})
 
 	// set to True when captcha requested with lite template flag
-	var isLiteTemplate bool
+	isLiteTemplate := isLiteTemplateRequested(r.Header)
 
-	// check for lite template header
-	if strings.EqualFold(r.Header.Get("X-LiteTemplate"), "TRUE") {
-		isLiteTemplate = true
+	// get requested challenge type
+	challengeType := getChallengeType(r.Header)
+
+	// fall back to image captcha after failed JS browser-check
+	if challengeType == challengeTypeJS {
+		if _, err := r.Cookie(fallbackName); err == nil {
+			challengeType = challengeTypeImage
+		}
 	}
 
+	// set to True when captcha requested in JSON API mode
+	isAPI := isAPIRequest(r.Header)
+
+	// JS browser-check requires page render, API clients get image captcha
+	if isAPI && challengeType == challengeTypeJS {
+		challengeType = challengeTypeImage
+	}
+
+	// redirect to central SSO domain, it issues assertion for already solved session
+	if !isAPI && !isLiteTemplate {
+		if ssoURL, ok := getSSOStartURL(r); ok {
+			logEvent(
+				slog.LevelInfo, r, http.StatusSeeOther, messageSSORedirect,
+				"domain", domain,
+			)
+
+			http.Redirect(w, r, ssoURL, http.StatusSeeOther)
+
+			return
+		}
+	}
+
+	// get challenge lineage, it links consecutive challenges of a single client
+	var lineage string
+
+	if cookie, err := r.Cookie(lineageName); err == nil && reUUID.MatchString(cookie.Value) {
+		lineage = cookie.Value
+	} else if lineage, err = genUUID(); err == nil {
+		http.SetCookie(w, &http.Cookie{
+			Name:     lineageName,
+			Value:    lineage,
+			Secure:   isHTTPS(r.Header),
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+		})
+	}
+
+	// generate honeypot inputs for captcha form
+	honeypots, err := newHoneypots()
+	if err != nil {
+		logEvent(
+			slog.LevelError, r, http.StatusInternalServerError, messageFailedEntropy,
+			"domain", domain,
+		)
+
+		// return proper HTTP error
+		httpError(w, r, messageFailedEntropy, http.StatusInternalServerError)
+
+		return
+	}
+
+	// compute difficulty level from previous failures
+	level := getDifficulty(r.Header.Get("X-Real-IP"), lineage)
+
 	// get random captcha from memory
-	challenge, b64str := captchaDB.GetRandomKeyValue()
+	challenge, b64str := captchaDB.Load().GetRandomKeyValue()
+	length := defaultCaptchaLength
+
+	// generate harder captcha after repeated failures
+	if level > 0 && challengeType == challengeTypeImage {
+		length += level
+
+		challenge, b64str, err = createCaptcha(escalatedOptions[level-1])
+		if err != nil {
+			logEvent(
+				slog.LevelError, r, http.StatusInternalServerError, messageFailedChallenge,
+				"domain", domain,
+			)
+
+			// return proper HTTP error
+			httpError(w, r, messageFailedChallenge, http.StatusInternalServerError)
+
+			return
+		}
+	}
 
 	// set how long cookie is valid
-	challengeTTL := time.Duration(challengeExpirationSeconds * nanoSecondsInSecond)
-	// generate expire date for captcha hash
-	expires := time.Now().Add(challengeTTL)
-
-	Info.Printf(
-		"%d, RAddr:'%s', URL:'%s%s', Dom:'%s', UA:'%s', Challenge:'%s', TTL:'%s'\n",
-		http.StatusOK,
-		r.Header.Get("X-Real-IP"),
-		r.Header.Get("X-Forwarded-Host"),
-		r.Header.Get("X-Original-URI"),
-		domain, r.UserAgent(),
-		challenge, challengeTTL,
+	challengeTTL := getPolicy(r.Header.Get("X-Forwarded-Host")).getChallengeTTL()
+	// generate issue and expire dates for captcha hash
+	issued := time.Now()
+	expires := issued.Add(challengeTTL)
+
+	logEvent(
+		slog.LevelInfo, r, http.StatusOK, messageIssuedChallenge,
+		"domain", domain,
+		"challenge", challenge,
+		"difficulty", level,
+		"ttl", challengeTTL.String(),
 	)
 
+	metricChallengesIssued.Inc(getMetricDomain(r.Header), challengeType)
+
+	emitEvent(event{
+		Type:      eventChallengeIssued,
+		Domain:    getRequestDomain(r.Header),
+		Address:   r.Header.Get("X-Real-IP"),
+		UserAgent: r.UserAgent(),
+		Challenge: challengeType,
+	})
+
 	// populate struct with needed data for template render
-	data := struct {
-		Base64       string
-		TextHash     string
-		ChallengeKey string
-		ResponseKey  string
-		ImageID      string
-	}{
+	data := templateData{
 		// base64 encoded JPEG for data:URI
 		Base64: b64str,
 		// set captcha text hash
@@ -162,30 +213,131 @@ func renderHandle(w http.ResponseWriter, r *http.Request) {
 		ChallengeKey: challengeKey,
 		ResponseKey:  responseKey,
 		ImageID:      imageID,
+		// captcha text length
+		Length: length,
+		// hidden inputs that must stay empty
+		Honeypots: honeypots,
+
+		TrajectoryKey: trajectoryKey,
+	}
+
+	// generate alternative challenge, image captcha is kept as no-script fallback
+	if challengeType != challengeTypeImage {
+		record := captchaDBRecord{
+			Type:    challengeType,
+			Sibling: data.TextHash,
+			Lineage: lineage,
+
+			Domain:    domain,
+			UserAgent: getRecordUserAgent(r.UserAgent()),
+			Issued:    issued,
+			Expires:   expires,
+
+			Address: getRecordAddress(r.Header.Get("X-Real-IP")),
+
+			URI: getReturnURI(r.Header.Get("X-Original-URI")),
+		}
+
+		var id string
+
+		switch challengeType {
+		case challengeTypeJS:
+			var check jsCheck
+
+			check, err = newJSCheck(jsCheckOperations * (1 + level))
+
+			record.Solution = getStringHash(check.Answer)
+
+			data.JSScript = template.JS(check.Script)
+			data.JSDelay = getJSCheckDelay()
+		case challengeTypeSlider:
+			var puzzle sliderPuzzle
+
+			puzzle, err = newSliderPuzzle(b64str)
+
+			record.Offset = puzzle.X
+
+			data.SliderBackground = puzzle.Background
+			data.SliderPiece = puzzle.Piece
+			data.SliderY = puzzle.Y
+			data.SliderMax = puzzle.Width - sliderPieceSize
+		}
+
+		if err == nil {
+			id, err = genUUID()
+		}
+
+		if err != nil {
+			logEvent(
+				slog.LevelError, r, http.StatusInternalServerError, messageFailedChallenge,
+				"domain", domain,
+			)
+
+			// return proper HTTP error
+			httpError(w, r, messageFailedChallenge, http.StatusInternalServerError)
+
+			return
+		}
+
+		// hash of UUID is used so that key is never treated as authentication ID
+		data.AltChallenge = getStringHash(id)
+
+		logEvent(
+			slog.LevelInfo, r, http.StatusOK, messageIssuedChallenge,
+			"domain", domain,
+			"challenge", data.AltChallenge,
+			"type", challengeType,
+			"ttl", challengeTTL.String(),
+		)
+
+		// store alternative challenge to db
+		start := time.Now()
+		db.Store(data.AltChallenge, record)
+		observeStore(r, start)
 	}
 
 	// store captcha hash to db
+	start := time.Now()
 	db.Store(data.TextHash,
 		captchaDBRecord{
+			Type:     challengeTypeImage,
+			Solution: data.TextHash,
+			Sibling:  data.AltChallenge,
+			Lineage:  lineage,
+
+			Honeypots: getHoneypotNames(data.Honeypots),
+
 			Domain:    domain,
-			UserAgent: r.UserAgent(),
+			UserAgent: getRecordUserAgent(r.UserAgent()),
+			Issued:    issued,
 			Expires:   expires,
 
-			Address: r.Header.Get("X-Real-IP"),
+			Address: getRecordAddress(r.Header.Get("X-Real-IP")),
+			BanKey:  getRecordBanKey(r.Header.Get("X-Real-IP")),
+
+			URI: getReturnURI(r.Header.Get("X-Original-URI")),
 		},
 	)
+	observeStore(r, start)
+
+	setSpanOutcome(r, messageIssuedChallenge)
 
 	// https://www.fastly.com/blog/clearing-cache-browser
 	// https://www.w3.org/TR/clear-site-data/
 	w.Header().Set("Clear-Site-Data", `"cache"`)
 
-	var err error
-
-	// render captcha template
-	if isLiteTemplate {
-		err = captchaLiteTemplate.Execute(w, data)
-	} else {
-		err = captchaHTMLTemplate.Execute(w, data)
+	// render captcha template, alternative challenges are always rendered as full page
+	switch {
+	case isAPI:
+		err = writeJSON(w, http.StatusOK, newAPIChallenge(challengeType, data, expires))
+	case challengeType == challengeTypeJS:
+		err = templates.Load().JS.Execute(w, data)
+	case challengeType == challengeTypeSlider:
+		err = templates.Load().Slider.Execute(w, data)
+	case isLiteTemplate:
+		err = templates.Load().Lite.Execute(w, data)
+	default:
+		err = templates.Load().HTML.Execute(w, data)
 	}
 
 	if err != nil {
@@ -194,18 +346,13 @@ func renderHandle(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		Error.Printf(
-			"%d, RAddr:'%s', URL:'%s%s', Dom:'%s', UA:'%s', %s\n",
-			http.StatusInternalServerError,
-			r.Header.Get("X-Real-IP"),
-			r.Header.Get("X-Forwarded-Host"),
-			r.Header.Get("X-Original-URI"),
-			domain, r.UserAgent(),
-			messageFailedHTMLRender,
+		logEvent(
+			slog.LevelError, r, http.StatusInternalServerError, messageFailedHTMLRender,
+			"domain", domain,
 		)
 
 		// return proper HTTP error
-		http.Error(w, messageFailedHTMLRender, http.StatusInternalServerError)
+		httpError(w, r, messageFailedHTMLRender, http.StatusInternalServerError)
 
 		return
 	}
@@ -214,45 +361,47 @@ func renderHandle(w http.ResponseWriter, r *http.Request) {
 func validateHandle(w http.ResponseWriter, r *http.Request) {
 	// allow only POST method
 	if r.Method != http.MethodPost {
-		Debug.Printf(
-			"%d, RAddr:'%s', URL:'%s%s', UA:'%s', %s\n",
-			http.StatusMethodNotAllowed,
-			r.Header.Get("X-Real-IP"),
-			r.Header.Get("X-Forwarded-Host"),
-			r.Header.Get("X-Original-URI"),
-			r.UserAgent(), messageOnlyPostMethod,
-		)
+		logEvent(slog.LevelDebug, r, http.StatusMethodNotAllowed, messageOnlyPostMethod)
 
 		// return proper HTTP error with headers
 		w.Header().Set("Allow", http.MethodPost)
-		http.Error(w, messageOnlyPostMethod, http.StatusMethodNotAllowed)
+		httpError(w, r, messageOnlyPostMethod, http.StatusMethodNotAllowed)
 
 		return
 	}
 
+	// reject banned address
+	if rejectBanned(w, r) {
+		return
+	}
+
 	// define domain for a cookie
-	domain := r.Header.Get("X-Forwarded-Host")
+	domain := getCookieDomain(r.Header)
 
-	// compute wildcard domain cookie when appropriate configuration header present
-	if strings.EqualFold(r.Header.Get("X-TLDPlusOne"), "TRUE") {
-		if val, err := publicsuffix.EffectiveTLDPlusOne(r.Header.Get("X-Forwarded-Host")); err == nil {
-			domain = "." + val
-		}
+	// read validation request from form or JSON body
+	input, err := getValidationRequest(w, r)
+	if err != nil {
+		logEvent(
+			slog.LevelInfo, r, getRejectStatus(r.Header), messageInvalidRequest,
+			"domain", domain,
+		)
+
+		// reject challenge
+		rejectChallenge(w, r, messageInvalidRequest)
+
+		return
 	}
 
 	// get captcha answer, case insensitive
-	response := strings.ToUpper(r.PostFormValue(responseKey))
+	response := strings.ToUpper(input.Response)
 	// get hidden captcha answer
-	challenge := r.PostFormValue(challengeKey)
-
-	Debug.Printf(
-		"%d, RAddr:'%s', URL:'%s%s', Dom:'%s', UA:'%s', Response:'%s', Challenge:'%s'\n",
-		http.StatusOK,
-		r.Header.Get("X-Real-IP"),
-		r.Header.Get("X-Forwarded-Host"),
-		r.Header.Get("X-Original-URI"),
-		domain, r.UserAgent(),
-		response, challenge,
+	challenge := input.Challenge
+
+	logEvent(
+		slog.LevelDebug, r, http.StatusOK, messageValidationRequest,
+		"domain", domain,
+		"response", response,
+		"challenge", challenge,
 	)
 
 	// https://www.fastly.com/blog/clearing-cache-browser
@@ -260,20 +409,19 @@ func validateHandle(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Clear-Site-Data", `"cache"`)
 
 	// lookup captcha hash in db
+	start := time.Now()
 	val, ok := db.Load(challenge)
+	observeStore(r, start)
+
 	if !ok {
-		Info.Printf(
-			"%d, RAddr:'%s', URL:'%s%s', Dom:'%s', UA:'%s', Challenge:'%s', %s\n",
-			http.StatusSeeOther,
-			r.Header.Get("X-Real-IP"),
-			r.Header.Get("X-Forwarded-Host"),
-			r.Header.Get("X-Original-URI"),
-			domain, r.UserAgent(),
-			challenge, messageUnknownChallenge,
+		logEvent(
+			slog.LevelInfo, r, getRejectStatus(r.Header), messageUnknownChallenge,
+			"domain", domain,
+			"challenge", challenge,
 		)
 
-		// redirect to self
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		// reject challenge
+		rejectChallenge(w, r, messageUnknownChallenge)
 
 		return
 	}
@@ -281,165 +429,285 @@ func validateHandle(w http.ResponseWriter, r *http.Request) {
 	// check captcha hash record
 	record, ok := val.(captchaDBRecord)
 	if !ok {
-		Error.Printf(
-			"%d, RAddr:'%s', URL:'%s%s', Dom:'%s', UA:'%s', Challenge:'%s', %s\n",
-			http.StatusInternalServerError,
-			r.Header.Get("X-Real-IP"),
-			r.Header.Get("X-Forwarded-Host"),
-			r.Header.Get("X-Original-URI"),
-			domain, r.UserAgent(),
-			challenge, messageUnknownChallenge,
+		logEvent(
+			slog.LevelError, r, http.StatusInternalServerError, messageUnknownChallenge,
+			"domain", domain,
+			"challenge", challenge,
 		)
 
 		// return proper HTTP error
-		http.Error(w, messageUnknownChallenge, http.StatusInternalServerError)
+		httpError(w, r, messageUnknownChallenge, http.StatusInternalServerError)
 
 		return
 	}
 
 	// check that captcha hash is valid for domain
 	if !strings.EqualFold(domain, record.Domain) {
-		Info.Printf(
-			"%d, RAddr:'%s', URL:'%s%s', Dom:'%s', UA:'%s', Challenge:'%s', %s\n",
-			http.StatusSeeOther,
-			r.Header.Get("X-Real-IP"),
-			r.Header.Get("X-Forwarded-Host"),
-			r.Header.Get("X-Original-URI"),
-			domain, r.UserAgent(),
-			challenge, messageInvalidChallenge,
+		logEvent(
+			slog.LevelInfo, r, getRejectStatus(r.Header), messageInvalidChallenge,
+			"domain", domain,
+			"challenge", challenge,
 		)
 
-		// redirect to self
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		// reject challenge
+		rejectChallenge(w, r, messageInvalidChallenge)
 
 		return
 	}
 
 	// check captcha hash expiration
 	if record.Expires.Before(time.Now()) {
-		Info.Printf(
-			"%d, RAddr:'%s', URL:'%s%s', Dom:'%s', UA:'%s', Challenge:'%s', %s\n",
-			http.StatusSeeOther,
-			r.Header.Get("X-Real-IP"),
-			r.Header.Get("X-Forwarded-Host"),
-			r.Header.Get("X-Original-URI"),
-			domain, r.UserAgent(),
-			challenge, messageExpiredChallenge,
+		logEvent(
+			slog.LevelInfo, r, getRejectStatus(r.Header), messageExpiredChallenge,
+			"domain", domain,
+			"challenge", challenge,
+		)
+
+		// reject challenge
+		rejectChallenge(w, r, messageExpiredChallenge)
+
+		return
+	}
+
+	// reject form with filled honeypot inputs
+	if isHoneypotFilled(r, record.Honeypots) {
+		logBot(
+			getRejectStatus(r.Header), messageFilledHoneypot,
+			"domain", record.Domain,
+			"remote_addr", r.Header.Get("X-Real-IP"),
+			"ua", r.UserAgent(),
+		)
+
+		logEvent(
+			slog.LevelInfo, r, getRejectStatus(r.Header), messageFilledHoneypot,
+			"domain", domain,
+			"challenge", challenge,
 		)
 
-		// redirect to self
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		// filled honeypot invalidates challenge
+		db.Delete(challenge)
+
+		if record.Sibling != "" {
+			db.Delete(record.Sibling)
+		}
+
+		countFailure(r.Header.Get("X-Real-IP"), record.Lineage, messageFilledHoneypot)
+
+		// reject challenge
+		rejectChallenge(w, r, messageFilledHoneypot)
+
+		return
+	}
+
+	// measure time spent on challenge
+	solveTime := time.Since(record.Issued)
+
+	solveTimes.Observe(solveTime.Seconds(), record.Type)
+
+	// reject response that is too fast for a human
+	if solveTime < cmdMinSolveTime {
+		logBot(
+			getRejectStatus(r.Header), messageTooFastResponse,
+			"domain", record.Domain,
+			"remote_addr", r.Header.Get("X-Real-IP"),
+			"ua", r.UserAgent(),
+			"solve_time", solveTime.String(),
+		)
+
+		logEvent(
+			slog.LevelInfo, r, getRejectStatus(r.Header), messageTooFastResponse,
+			"domain", domain,
+			"challenge", challenge,
+		)
+
+		// too fast response invalidates challenge
+		db.Delete(challenge)
+
+		if record.Sibling != "" {
+			db.Delete(record.Sibling)
+		}
+
+		countFailure(r.Header.Get("X-Real-IP"), record.Lineage, messageTooFastResponse)
+
+		// reject challenge
+		rejectChallenge(w, r, messageTooFastResponse)
 
 		return
 	}
 
 	// validate user inputed captcha response
-	if getStringHash(response) != challenge {
-		Info.Printf(
-			"%d, RAddr:'%s', URL:'%s%s', Dom:'%s', UA:'%s', Challenge:'%s', %s\n",
-			http.StatusSeeOther,
-			r.Header.Get("X-Real-IP"),
-			r.Header.Get("X-Forwarded-Host"),
-			r.Header.Get("X-Original-URI"),
-			domain, r.UserAgent(),
-			challenge, messageInvalidResponse,
+	var isValidResponse bool
+
+	switch record.Type {
+	case challengeTypeSlider:
+		isValidResponse = isValidSliderResponse(record.Offset, response, input.Trajectory)
+	default:
+		isValidResponse = getStringHash(response) == record.Solution
+	}
+
+	if !isValidResponse {
+		// count failures to escalate difficulty of following challenges
+		countFailure(r.Header.Get("X-Real-IP"), record.Lineage, messageInvalidResponse)
+
+		// failed JS browser-check falls back to image captcha
+		if record.Type == challengeTypeJS {
+			http.SetCookie(w, &http.Cookie{
+				Name:     fallbackName,
+				Value:    "1",
+				Expires:  time.Now().Add(time.Duration(fallbackExpirationSeconds * nanoSecondsInSecond)),
+				MaxAge:   fallbackExpirationSeconds,
+				Secure:   isHTTPS(r.Header),
+				HttpOnly: true,
+				SameSite: http.SameSiteStrictMode,
+			})
+		}
+
+		logEvent(
+			slog.LevelInfo, r, getRejectStatus(r.Header), messageInvalidResponse,
+			"domain", domain,
+			"challenge", challenge,
 		)
 
-		// redirect to self
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		// reject challenge
+		rejectChallenge(w, r, messageInvalidResponse)
 
 		return
 	}
 
-	// generate ID for cookie value
-	id, err := genUUID()
+	// set how long cookie is valid
+	authenticationTTL := getPolicy(r.Header.Get("X-Forwarded-Host")).getAuthTTL()
+
+	// challenge is valid, create session and set authentication cookie
+	id, expires, err := newSession(w, r, domain, authenticationTTL)
 	if err != nil {
-		Error.Printf(
-			"%d, RAddr:'%s', URL:'%s%s', Dom:'%s', UA:'%s', %s\n",
-			http.StatusInternalServerError,
-			r.Header.Get("X-Real-IP"),
-			r.Header.Get("X-Forwarded-Host"),
-			r.Header.Get("X-Original-URI"),
-			domain, r.UserAgent(),
-			messageFailedEntropy,
+		logEvent(
+			slog.LevelError, r, http.StatusInternalServerError, messageFailedEntropy,
+			"domain", domain,
 		)
 
 		// return proper HTTP error
-		http.Error(w, messageFailedEntropy, http.StatusInternalServerError)
+		httpError(w, r, messageFailedEntropy, http.StatusInternalServerError)
 
 		return
 	}
 
-	// set how long cookie is valid
-	authenticationTTL := time.Duration(authenticationExpirationSeconds * nanoSecondsInSecond)
-	// generate expire date for authentication hash
-	expires := time.Now().Add(authenticationTTL)
-
-	Info.Printf(
-		"%d, RAddr:'%s', URL:'%s%s', Dom:'%s', UA:'%s', Response:'%s', Challenge:'%s', Auth:'%s', TTL:'%s'\n",
-		http.StatusOK,
-		r.Header.Get("X-Real-IP"),
-		r.Header.Get("X-Forwarded-Host"),
-		r.Header.Get("X-Original-URI"),
-		domain, r.UserAgent(),
-		response, challenge,
-		id, authenticationTTL,
+	logEvent(
+		slog.LevelInfo, r, http.StatusOK, messageSolvedChallenge,
+		"domain", domain,
+		"response", response,
+		"challenge", challenge,
+		"auth_id", id,
+		"ttl", authenticationTTL.String(),
 	)
 
-	// challenge is valid, invalidating used challenge hash
+	// challenge is solved, reset difficulty and forgive one failure of address
+	failures.Reset(r.Header.Get("X-Real-IP"))
+	failures.Reset(record.Lineage)
+	bans.Forgive(r.Header.Get("X-Real-IP"))
+
+	metricValidations.Inc(getMetricDomain(r.Header), "success")
+
+	setSpanOutcome(r, messageSolvedChallenge)
+
+	emitEvent(event{
+		Type:      eventChallengeSolved,
+		Domain:    getRequestDomain(r.Header),
+		Address:   r.Header.Get("X-Real-IP"),
+		UserAgent: r.UserAgent(),
+		Challenge: record.Type,
+	})
+
+	// invalidating used challenge hash and its alternative
 	db.Delete(challenge)
 
-	// store captcha hash to db
-	db.Store(id,
-		captchaDBRecord{
-			Domain:    domain,
-			UserAgent: r.UserAgent(),
-			Expires:   expires,
+	if record.Sibling != "" {
+		db.Delete(record.Sibling)
+	}
 
-			Address: r.Header.Get("X-Real-IP"),
-		},
-	)
+	// reply with token in API mode
+	if isAPIRequest(r.Header) {
+		if err = writeJSON(w, http.StatusOK, apiValidation{
+			Success:    true,
+			Token:      id,
+			CookieName: authenticationName,
+			Expires:    &expires,
+			Redirect:   getReturnURI(record.URI),
+		}); err != nil {
+			logEvent(
+				slog.LevelDebug, r, http.StatusOK, messageFailedHTTPResponse,
+				"domain", domain,
+			)
+		}
 
-	// set cookie for wildcard domain cookie, domain starts with '.'
-	if strings.HasPrefix(domain, ".") {
-		http.SetCookie(w, &http.Cookie{
-			Domain:   domain,
-			Name:     authenticationName,
-			Value:    id,
-			Expires:  expires,
-			MaxAge:   int(expires.Unix() - time.Now().Unix()),
-			Secure:   isHTTPS(r.Header),
-			HttpOnly: false,
-			SameSite: http.SameSiteNoneMode,
-		})
-	} else { // non-wildcard cookie
-		http.SetCookie(w, &http.Cookie{
-			Name:     authenticationName,
-			Value:    id,
-			Expires:  expires,
-			MaxAge:   int(expires.Unix() - time.Now().Unix()),
-			Secure:   isHTTPS(r.Header),
-			HttpOnly: true,
-			SameSite: http.SameSiteStrictMode,
-		})
+		return
 	}
 
-	// redirect to self
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	// redirect to originally requested URI
+	http.Redirect(w, r, getReturnURI(record.URI), http.StatusSeeOther)
 }
 
 func authHandle(w http.ResponseWriter, r *http.Request) {
 	// allow web font for '@font-face' request from CSS
 	if strings.EqualFold(r.Header.Get("X-Allow-Web-Font"), "TRUE") &&
 		isFontInURL(r.Header.Get("X-Original-URI")) {
-		Debug.Printf(
-			"%d, RAddr:'%s', URL:'%s%s', UA:'%s', %s\n",
-			http.StatusOK,
-			r.Header.Get("X-Real-IP"),
-			r.Header.Get("X-Forwarded-Host"),
-			r.Header.Get("X-Original-URI"),
-			r.UserAgent(), messageAllowWebFont,
+		logEvent(slog.LevelDebug, r, http.StatusOK, messageAllowWebFont)
+
+		countAuthDecision(r, messageAllowWebFont)
+
+		return
+	}
+
+	// get policy for requested host
+	policy := getPolicy(r.Header.Get("X-Forwarded-Host"))
+
+	// allow URI paths exempted by policy
+	if policy.isExemptPath(r.Header.Get("X-Original-URI")) {
+		logEvent(slog.LevelDebug, r, http.StatusOK, messageAllowExemptPath)
+
+		countAuthDecision(r, messageAllowExemptPath)
+
+		return
+	}
+
+	// allow requests matched by allowlist rules
+	if rule, ok := getAllowRule(r.Header); ok {
+		logEvent(
+			slog.LevelInfo, r, http.StatusOK, messageAllowListed,
+			"rule", rule,
+		)
+
+		countAuthDecision(r, messageAllowListed)
+
+		return
+	}
+
+	// allow search engine crawlers confirmed with reverse DNS
+	if c, ok := getCrawler(r.UserAgent()); ok && crawlers != nil {
+		host, valid := crawlers.Verify(c, r.Header.Get("X-Real-IP"))
+		if valid {
+			logEvent(
+				slog.LevelInfo, r, http.StatusOK, messageAllowCrawler,
+				"crawler", c.Name,
+				"crawler_host", host,
+			)
+
+			countAuthDecision(r, messageAllowCrawler)
+
+			return
+		}
+
+		logBot(
+			unAuthorizedAccess, messageUnverifiedCrawler,
+			"domain", r.Header.Get("X-Forwarded-Host"),
+			"remote_addr", r.Header.Get("X-Real-IP"),
+			"ua", r.UserAgent(),
+			"crawler", c.Name,
 		)
+	}
+
+	// reject banned address
+	if rejectBanned(w, r) {
+		countAuthDecision(r, messageBanned)
 
 		return
 	}
@@ -447,46 +715,35 @@ func authHandle(w http.ResponseWriter, r *http.Request) {
 	// get challenge cookie value from request
 	auth, err := r.Cookie(authenticationName)
 	if err != nil || auth == nil {
-		Debug.Printf(
-			"%d, RAddr:'%s', URL:'%s%s', UA:'%s', %s\n",
-			unAuthorizedAccess,
-			r.Header.Get("X-Real-IP"),
-			r.Header.Get("X-Forwarded-Host"),
-			r.Header.Get("X-Original-URI"),
-			r.UserAgent(), messageEmptyAuthentication,
-		)
+		logEvent(slog.LevelDebug, r, unAuthorizedAccess, messageEmptyAuthentication)
+
+		countAuthDecision(r, messageEmptyAuthentication)
 
 		// return proper HTTP error
-		http.Error(w, messageEmptyAuthentication, unAuthorizedAccess)
+		httpError(w, r, messageEmptyAuthentication, unAuthorizedAccess)
 
 		return
 	}
 
 	// define domain for a cookie
-	domain := r.Header.Get("X-Forwarded-Host")
-
-	// compute wildcard domain cookie when appropriate configuration header present
-	if strings.EqualFold(r.Header.Get("X-TLDPlusOne"), "TRUE") {
-		if val, err := publicsuffix.EffectiveTLDPlusOne(r.Header.Get("X-Forwarded-Host")); err == nil {
-			domain = "." + val
-		}
-	}
+	domain := getCookieDomain(r.Header)
 
 	// lookup cookie value in db
+	start := time.Now()
 	val, ok := db.Load(auth.Value)
+	observeStore(r, start)
+
 	if !ok {
-		Debug.Printf(
-			"%d, RAddr:'%s', URL:'%s%s', Dom:'%s', UA:'%s', Auth:'%s', %s\n",
-			unAuthorizedAccess,
-			r.Header.Get("X-Real-IP"),
-			r.Header.Get("X-Forwarded-Host"),
-			r.Header.Get("X-Original-URI"),
-			domain, r.UserAgent(),
-			auth.Value, messageUnknownAuthentication,
+		logEvent(
+			slog.LevelDebug, r, unAuthorizedAccess, messageUnknownAuthentication,
+			"domain", domain,
+			"auth_id", auth.Value,
 		)
 
+		countAuthDecision(r, messageUnknownAuthentication)
+
 		// return proper HTTP error
-		http.Error(w, messageUnknownAuthentication, unAuthorizedAccess)
+		httpError(w, r, messageUnknownAuthentication, unAuthorizedAccess)
 
 		return
 	}
@@ -494,33 +751,43 @@ func authHandle(w http.ResponseWriter, r *http.Request) {
 	// check challenge hash record
 	record, ok := val.(captchaDBRecord)
 	if !ok {
-		Error.Printf(
-			"%d, RAddr:'%s', URL:'%s%s', Dom:'%s', UA:'%s', Auth:'%s', %s\n",
-			unAuthorizedAccess,
-			r.Header.Get("X-Real-IP"),
-			r.Header.Get("X-Forwarded-Host"),
-			r.Header.Get("X-Original-URI"),
-			domain, r.UserAgent(),
-			auth.Value, messageUnknownAuthentication,
+		logEvent(
+			slog.LevelError, r, unAuthorizedAccess, messageUnknownAuthentication,
+			"domain", domain,
+			"auth_id", auth.Value,
 		)
 
+		countAuthDecision(r, messageUnknownAuthentication)
+
 		// return proper HTTP error
-		http.Error(w, messageUnknownAuthentication, unAuthorizedAccess)
+		httpError(w, r, messageUnknownAuthentication, unAuthorizedAccess)
+
+		return
+	}
+
+	// check that cookie points to session, challenges and widget tokens are not authentication
+	if record.Type != recordTypeSession {
+		logEvent(
+			slog.LevelDebug, r, unAuthorizedAccess, messageUnknownAuthentication,
+			"domain", domain,
+			"auth_id", auth.Value,
+		)
+
+		countAuthDecision(r, messageUnknownAuthentication)
+
+		// return proper HTTP error
+		httpError(w, r, messageUnknownAuthentication, unAuthorizedAccess)
 
 		return
 	}
 
 	// check that cookie is valid for domain
 	if !strings.EqualFold(domain, record.Domain) {
-		Debug.Printf(
-			"%d, RAddr:'%s', URL:'%s%s', Dom:'%s', UA:'%s', Auth:'%s', %s (%s)\n",
-			unAuthorizedAccess,
-			r.Header.Get("X-Real-IP"),
-			r.Header.Get("X-Forwarded-Host"),
-			r.Header.Get("X-Original-URI"),
-			domain, r.UserAgent(), auth.Value,
-			messageInvalidAuthenticationDomain,
-			record.Domain,
+		logEvent(
+			slog.LevelDebug, r, unAuthorizedAccess, messageInvalidAuthenticationDomain,
+			"domain", domain,
+			"auth_id", auth.Value,
+			"expected", record.Domain,
 		)
 
 		// when we switch form wildcard to none-wildcard cookie we need to clean DB records for this domain
@@ -531,53 +798,69 @@ func authHandle(w http.ResponseWriter, r *http.Request) {
 			db.Delete(auth.Value)
 		}
 
+		countAuthDecision(r, messageInvalidAuthenticationDomain)
+
 		// return proper HTTP error
-		http.Error(w, messageInvalidAuthenticationDomain, unAuthorizedAccess)
+		httpError(w, r, messageInvalidAuthenticationDomain, unAuthorizedAccess)
 
 		return
 	}
 
 	// check that cookie is valid for UA
-	if !strings.EqualFold(r.UserAgent(), record.UserAgent) {
-		Debug.Printf(
-			"%d, RAddr:'%s', URL:'%s%s', Dom:'%s', UA:'%s', Auth:'%s', %s (%s)\n",
-			unAuthorizedAccess,
-			r.Header.Get("X-Real-IP"),
-			r.Header.Get("X-Forwarded-Host"),
-			r.Header.Get("X-Original-URI"),
-			domain, r.UserAgent(), auth.Value,
-			messageInvalidUserAgent, record.UserAgent,
+	if policy.isUserAgentBound() && !isRecordUserAgent(record.UserAgent, r.UserAgent()) {
+		logEvent(
+			slog.LevelDebug, r, unAuthorizedAccess, messageInvalidUserAgent,
+			"domain", domain,
+			"auth_id", auth.Value,
+			"expected_ua", record.UserAgent,
 		)
 
+		countAuthDecision(r, messageInvalidUserAgent)
+
 		// return proper HTTP error
-		http.Error(w, messageInvalidUserAgent, unAuthorizedAccess)
+		httpError(w, r, messageInvalidUserAgent, unAuthorizedAccess)
+
+		return
+	}
+
+	// check that cookie is valid for address
+	if policy.isAddressBound() && !isRecordAddress(record.Address, r.Header.Get("X-Real-IP")) {
+		logEvent(
+			slog.LevelDebug, r, unAuthorizedAccess, messageInvalidAddress,
+			"domain", domain,
+			"auth_id", auth.Value,
+			"expected_addr", record.Address,
+		)
+
+		countAuthDecision(r, messageInvalidAddress)
+
+		// return proper HTTP error
+		httpError(w, r, messageInvalidAddress, unAuthorizedAccess)
 
 		return
 	}
 
 	// check cookie expiration
 	if !record.Expires.After(time.Now()) {
-		Debug.Printf(
-			"%d, RAddr:'%s', URL:'%s%s', Dom:'%s', UA:'%s', Auth:'%s', %s\n",
-			unAuthorizedAccess,
-			r.Header.Get("X-Real-IP"),
-			r.Header.Get("X-Forwarded-Host"),
-			r.Header.Get("X-Original-URI"),
-			domain, r.UserAgent(), auth.Value,
-			messageExpiredAuthentication,
+		logEvent(
+			slog.LevelDebug, r, unAuthorizedAccess, messageExpiredAuthentication,
+			"domain", domain,
+			"auth_id", auth.Value,
 		)
 
+		countAuthDecision(r, messageExpiredAuthentication)
+
 		// return proper HTTP error
-		http.Error(w, messageExpiredAuthentication, unAuthorizedAccess)
+		httpError(w, r, messageExpiredAuthentication, unAuthorizedAccess)
+
+		return
 	}
 
-	Debug.Printf(
-		"%d, RAddr:'%s', URL:'%s%s', Dom:'%s', UA:'%s', Auth:'%s', %s\n",
-		http.StatusOK,
-		r.Header.Get("X-Real-IP"),
-		r.Header.Get("X-Forwarded-Host"),
-		r.Header.Get("X-Original-URI"),
-		domain, r.UserAgent(), auth.Value,
-		messageValidAuthentication,
+	logEvent(
+		slog.LevelDebug, r, http.StatusOK, messageValidAuthentication,
+		"domain", domain,
+		"auth_id", auth.Value,
 	)
+
+	countAuthDecision(r, messageValidAuthentication)
 }
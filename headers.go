@@ -2,9 +2,67 @@ package main
 
 import (
 	"net/http"
+	"net/url"
 	"strings"
+
+	"golang.org/x/net/publicsuffix"
 )
 
 func isHTTPS(h http.Header) bool {
 	return strings.EqualFold(h.Get("X-Scheme"), "https")
 }
+
+// getChallengeType returns challenge type from domain policy or configuration,
+// request headers are not used as client is able to send them to downgrade challenge.
+func getChallengeType(h http.Header) string {
+	if p := getPolicy(h.Get("X-Forwarded-Host")); p.ChallengeType != "" {
+		return p.ChallengeType
+	}
+
+	return cmdChallengeType
+}
+
+// getReturnURI returns local path with query from original request URI,
+// any URI that may lead to another host is replaced with root path.
+func getReturnURI(uri string) string {
+	// reject protocol-relative, backslash and control characters tricks
+	if !strings.HasPrefix(uri, "/") || strings.HasPrefix(uri, "//") ||
+		strings.ContainsAny(uri, "\\\r\n\t") {
+		return "/"
+	}
+
+	u, err := url.ParseRequestURI(uri)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.User != nil {
+		return "/"
+	}
+
+	return u.RequestURI()
+}
+
+// getCookieDomain returns domain for authentication cookie, wildcard domain
+// is computed when domain policy or appropriate configuration header requests it.
+func getCookieDomain(h http.Header) string {
+	domain := h.Get("X-Forwarded-Host")
+	scope := getPolicy(domain).CookieScope
+
+	if scope == "" && strings.EqualFold(h.Get("X-TLDPlusOne"), "TRUE") {
+		scope = cookieScopeTLDPlusOne
+	}
+
+	if scope == cookieScopeTLDPlusOne {
+		if val, err := publicsuffix.EffectiveTLDPlusOne(h.Get("X-Forwarded-Host")); err == nil {
+			domain = "." + val
+		}
+	}
+
+	return domain
+}
+
+// isLiteTemplateRequested checks that domain policy or configuration header requests lite template.
+func isLiteTemplateRequested(h http.Header) bool {
+	if p := getPolicy(h.Get("X-Forwarded-Host")); p.Template != "" {
+		return p.Template == templateLite
+	}
+
+	return strings.EqualFold(h.Get("X-LiteTemplate"), "TRUE")
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// healthStatus defines JSON liveness and readiness response.
+type healthStatus struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// getReadinessChecks checks resources required to serve requests, empty map means ready.
+func getReadinessChecks() map[string]string {
+	failed := make(map[string]string)
+
+	if shuttingDown.Load() {
+		failed["shutdown"] = messageShuttingDown
+	}
+
+	switch status := captchaDBState.Load(); {
+	case status == nil || captchaDB.Load() == nil:
+		failed["captcha_db"] = "not loaded"
+	case status.Size == 0:
+		failed["captcha_db"] = "empty"
+	case status.Error != "":
+		failed["captcha_db"] = "reload failed: " + status.Error
+	}
+
+	// store, read and remove probe value, concurrent probes use different keys
+	probe := time.Now().UnixNano()
+	key := readinessProbeKey + strconv.FormatUint(readinessProbes.Add(1), 10)
+
+	db.Store(key, probe)
+
+	if val, ok := db.LoadAndDelete(key); !ok || val != probe {
+		failed["session_store"] = "probe value mismatch"
+	}
+
+	if templates.Load() == nil {
+		failed["templates"] = "not parsed"
+	}
+
+	return failed
+}
+
+func healthzHandle(w http.ResponseWriter, r *http.Request) {
+	writeAdminJSON(w, r, http.StatusOK, healthStatus{Status: "ok"})
+}
+
+func readyzHandle(w http.ResponseWriter, r *http.Request) {
+	failed := getReadinessChecks()
+	if len(failed) > 0 {
+		writeAdminJSON(w, r, http.StatusServiceUnavailable, healthStatus{Status: "not ready", Checks: failed})
+
+		return
+	}
+
+	writeAdminJSON(w, r, http.StatusOK, healthStatus{Status: "ready"})
+}
+
+// newAdminServer creates admin HTTP server, its requests are canceled when ctx is done.
+func newAdminServer(ctx context.Context) *http.Server {
+	return &http.Server{
+		Handler: newAdminMux(),
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+	}
+}
+
+// shutdownOnSignal gracefully shuts down servers when SIGTERM or SIGINT is received and closes done,
+// service reports not ready during shutdown delay before main server stops accepting requests.
+func shutdownOnSignal(done chan<- struct{}, srv, adminSrv *http.Server, cancelAdmin context.CancelFunc) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
+
+	s := <-c
+
+	shuttingDown.Store(true)
+
+	logInfo(messageShuttingDown, "signal", s.String(), "delay", cmdShutdownDelay.String())
+
+	time.Sleep(cmdShutdownDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), cmdShutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		logError(messageShutdownFailed, err, "address", cmdAddress)
+	}
+
+	if adminSrv != nil {
+		// stop dashboard streams
+		cancelAdmin()
+
+		if err := adminSrv.Shutdown(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			logError(messageShutdownFailed, err, "address", cmdAdminAddress)
+		}
+	}
+
+	// export queued spans
+	if tracer != nil {
+		if err := tracer.Close(ctx); err != nil {
+			logError(messageShutdownFailed, err)
+		}
+	}
+
+	// deliver queued events
+	if events != nil {
+		if err := events.Close(ctx); err != nil {
+			logError(messageShutdownFailed, err)
+		}
+	}
+
+	logInfo(messageShutdown)
+
+	close(done)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// honeypot defines hidden form input that must stay empty.
+type honeypot struct {
+	// Name defines randomized input name
+	Name string
+	// Label defines input label, label and name are not semantic so browsers do not autofill input
+	Label string
+}
+
+// newHoneypots generates honeypot inputs with randomized names.
+func newHoneypots() ([]honeypot, error) {
+	labels := []string{"Leave this field empty", "Do not fill this field"}
+	honeypots := make([]honeypot, 0, len(labels))
+
+	for _, label := range labels {
+		id, err := genUUID()
+		if err != nil {
+			return nil, err
+		}
+
+		honeypots = append(honeypots, honeypot{
+			Name:  "f" + strings.ReplaceAll(id, "-", "")[:12],
+			Label: label,
+		})
+	}
+
+	return honeypots, nil
+}
+
+// getHoneypotNames returns names of honeypot inputs.
+func getHoneypotNames(honeypots []honeypot) []string {
+	names := make([]string, 0, len(honeypots))
+
+	for _, h := range honeypots {
+		names = append(names, h.Name)
+	}
+
+	return names
+}
+
+// isHoneypotFilled checks that any of honeypot inputs is filled in submitted form.
+func isHoneypotFilled(r *http.Request, names []string) bool {
+	for _, name := range names {
+		if r.PostFormValue(name) != "" {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+)
+
+// journaldWriter writes log entries to systemd journal with native protocol.
+type journaldWriter struct {
+	conn *datagramConn
+}
+
+// newJournaldWriter creates journal writer for socket path, empty path uses systemd journal socket.
+func newJournaldWriter(path string) *journaldWriter {
+	if path == "" {
+		path = defaultJournaldPath
+	}
+
+	return &journaldWriter{conn: &datagramConn{path: path}}
+}
+
+// appendJournaldField appends field in native protocol, value with newline is length prefixed.
+func appendJournaldField(b *bytes.Buffer, name string, value []byte) {
+	if !bytes.ContainsRune(value, '\n') {
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.Write(value)
+		b.WriteByte('\n')
+
+		return
+	}
+
+	b.WriteString(name)
+	b.WriteByte('\n')
+
+	if err := binary.Write(b, binary.LittleEndian, uint64(len(value))); err != nil {
+		return
+	}
+
+	b.Write(value)
+	b.WriteByte('\n')
+}
+
+// Write sends journal entry with syslog priority, facility and identifier.
+func (j *journaldWriter) Write(facility, severity int, identifier string, msg []byte) error {
+	var b bytes.Buffer
+
+	appendJournaldField(&b, "MESSAGE", bytes.TrimRight(msg, "\n"))
+	appendJournaldField(&b, "PRIORITY", []byte(fmt.Sprint(severity)))
+	appendJournaldField(&b, "SYSLOG_FACILITY", []byte(fmt.Sprint(facility)))
+
+	if identifier != "" {
+		appendJournaldField(&b, "SYSLOG_IDENTIFIER", []byte(identifier))
+	}
+
+	if err := j.conn.Send(context.Background(), b.Bytes()); err != nil {
+		return fmt.Errorf("journald error: %w", err)
+	}
+
+	return nil
+}
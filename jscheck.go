@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// jsCheck contains generated browser-check computation.
+type jsCheck struct {
+	// Script is obfuscated JS expression that evaluates to a function returning answer
+	Script string
+	// Answer is expected result of computation
+	Answer string
+}
+
+// getRandomUint32 returns cryptographically secure random number.
+func getRandomUint32() (uint32, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return 0, err
+	}
+
+	return binary.LittleEndian.Uint32(b), nil
+}
+
+// newJSCheck generates browser-check computation with specified number of operations,
+// arithmetic is done with 32-bit integers to match JS semantics.
+func newJSCheck(operations int) (jsCheck, error) {
+	var body strings.Builder
+
+	seed, err := getRandomUint32()
+	if err != nil {
+		return jsCheck{}, err
+	}
+
+	v := int32(seed & 0xFFFF)
+	fmt.Fprintf(&body, "var v=%d;", v)
+
+	for i := 0; i < operations; i++ {
+		n, err := getRandomUint32()
+		if err != nil {
+			return jsCheck{}, err
+		}
+
+		// operand is kept small to avoid float precision issues in JS
+		k := int32(n>>16) | 1
+
+		switch n % 4 {
+		case 0:
+			v += k
+			fmt.Fprintf(&body, "v=(v+%d)|0;", k)
+		case 1:
+			v *= k
+			fmt.Fprintf(&body, "v=Math.imul(v,%d);", k)
+		case 2:
+			v ^= k
+			fmt.Fprintf(&body, "v=(v^%d)|0;", k)
+		case 3:
+			s := int(k%31) + 1
+			v = int32(bits.RotateLeft32(uint32(v), s))
+			fmt.Fprintf(&body, "v=((v<<%d)|(v>>>%d))|0;", s, 32-s)
+		}
+	}
+
+	// automated browsers compute wrong result and fall back to image captcha
+	body.WriteString("if(navigator.webdriver){v=v^1;}return v;")
+
+	key, err := getRandomUint32()
+	if err != nil {
+		return jsCheck{}, err
+	}
+
+	k := key%250 + 1
+
+	// encode function body as XORed char codes
+	codes := make([]string, 0, body.Len())
+	for _, c := range body.String() {
+		codes = append(codes, strconv.FormatUint(uint64(uint32(c)^k), 10))
+	}
+
+	script := fmt.Sprintf(
+		"(function(){var c=[%s],s='';for(var i=0;i<c.length;i++){s+=String.fromCharCode(c[i]^%d);}return new Function(s);})()",
+		strings.Join(codes, ","), k,
+	)
+
+	return jsCheck{
+		Script: script,
+		Answer: strconv.FormatInt(int64(v), 10),
+	}, nil
+}
+
+// getJSCheckDelay returns milliseconds before JS browser-check submits result,
+// delay is never shorter than minimal solve time so check is not rejected as too fast.
+func getJSCheckDelay() int {
+	minSolveTime := int((cmdMinSolveTime + time.Millisecond - 1) / time.Millisecond)
+
+	return max(jsCheckDelayMilliseconds, minSolveTime)
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// levelBot defines level of detected automation events, it is above INFO and below WARN.
+const levelBot = slog.Level(2)
+
+// parseLogLevel parses level name, "bot" is accepted as well.
+func parseLogLevel(s string) (slog.Level, error) {
+	if strings.EqualFold(s, "bot") {
+		return levelBot, nil
+	}
+
+	var level slog.Level
+
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return level, fmt.Errorf("log level error: %w", err)
+	}
+
+	return level, nil
+}
+
+// logOutput passes record level to leveled writer, formatting handler writes each record with single Write call.
+type logOutput struct {
+	mu    sync.Mutex
+	level slog.Level
+	write func(level slog.Level, b []byte) error
+}
+
+// leveledHandler sets record level on log output before record is formatted.
+type leveledHandler struct {
+	slog.Handler
+
+	out *logOutput
+}
+
+// Write sends formatted record, record is written to stderr when log daemon is unavailable.
+func (o *logOutput) Write(b []byte) (int, error) {
+	if err := o.write(o.level, b); err != nil {
+		return os.Stderr.Write(b)
+	}
+
+	return len(b), nil
+}
+
+// Handle formats record with record level set on log output.
+func (h *leveledHandler) Handle(ctx context.Context, rec slog.Record) error {
+	h.out.mu.Lock()
+	defer h.out.mu.Unlock()
+
+	h.out.level = rec.Level
+
+	return h.Handler.Handle(ctx, rec)
+}
+
+// WithAttrs returns leveled handler that shares log output.
+func (h *leveledHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &leveledHandler{Handler: h.Handler.WithAttrs(attrs), out: h.out}
+}
+
+// WithGroup returns leveled handler that shares log output.
+func (h *leveledHandler) WithGroup(name string) slog.Handler {
+	return &leveledHandler{Handler: h.Handler.WithGroup(name), out: h.out}
+}
+
+// isLogOutput checks log output name.
+func isLogOutput(output string) bool {
+	name, _, _ := strings.Cut(output, ":")
+
+	switch name {
+	case logOutputSyslog, logOutputJournald:
+		return true
+	default:
+		return output == logOutputStdout
+	}
+}
+
+// getLogSeverity maps log level to syslog severity, Bot records are notices.
+func getLogSeverity(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return syslogSeverityError
+	case level >= slog.LevelWarn:
+		return syslogSeverityWarning
+	case level >= levelBot:
+		return syslogSeverityNotice
+	case level >= slog.LevelInfo:
+		return syslogSeverityInfo
+	default:
+		return syslogSeverityDebug
+	}
+}
+
+// newLogOutputHandler creates log handler for output, syslog and journald records carry severity,
+// Bot records use own facility and tag.
+func newLogOutputHandler(output, format string) slog.Handler {
+	name, path, _ := strings.Cut(output, ":")
+
+	// facilities are checked in validateConfig
+	facility, _ := getSyslogFacility(cmdLogFacility)
+	botFacility, _ := getSyslogFacility(cmdLogBotFacility)
+
+	getFacilityTag := func(level slog.Level) (int, string) {
+		if level == levelBot {
+			return botFacility, cmdLogBotTag
+		}
+
+		return facility, cmdLogTag
+	}
+
+	var write func(level slog.Level, b []byte) error
+
+	switch name {
+	case logOutputSyslog:
+		w := newSyslogWriter(path)
+
+		write = func(level slog.Level, b []byte) error {
+			f, tag := getFacilityTag(level)
+
+			return w.Write(context.Background(), f, getLogSeverity(level), tag, "", b)
+		}
+	case logOutputJournald:
+		w := newJournaldWriter(path)
+
+		write = func(level slog.Level, b []byte) error {
+			f, tag := getFacilityTag(level)
+
+			return w.Write(f, getLogSeverity(level), tag, b)
+		}
+	default:
+		// errors are written to stderr, other records to stdout
+		write = func(level slog.Level, b []byte) error {
+			w := os.Stdout
+			if level >= slog.LevelError {
+				w = os.Stderr
+			}
+
+			_, err := w.Write(b)
+
+			return err
+		}
+	}
+
+	out := &logOutput{write: write}
+
+	return &leveledHandler{Handler: newLogHandler(out, format), out: out}
+}
+
+// formatLogLevel returns level name, "BOT" for automation events.
+func formatLogLevel(level slog.Level) string {
+	if level == levelBot {
+		return "BOT"
+	}
+
+	return level.String()
+}
+
+// sampleCounter counts events of a single kind within current sampling window.
+type sampleCounter struct {
+	start time.Time
+	count uint64
+}
+
+// samplingHandler passes first events of each level and reason within window, then every Nth event,
+// errors and Bot events are never sampled as external tools, like fail2ban, rely on every Bot record.
+type samplingHandler struct {
+	slog.Handler
+
+	mu         *sync.Mutex
+	counters   map[string]*sampleCounter
+	initial    uint64
+	thereafter uint64
+	window     time.Duration
+}
+
+// newSamplingHandler wraps handler with sampling, zero initial disables sampling.
+func newSamplingHandler(h slog.Handler, initial, thereafter uint64, window time.Duration) slog.Handler {
+	if initial == 0 {
+		return h
+	}
+
+	return &samplingHandler{
+		Handler:    h,
+		mu:         new(sync.Mutex),
+		counters:   make(map[string]*sampleCounter),
+		initial:    initial,
+		thereafter: thereafter,
+		window:     window,
+	}
+}
+
+// sample checks that event is passed to wrapped handler.
+func (h *samplingHandler) sample(rec slog.Record) bool {
+	if rec.Level >= slog.LevelError || rec.Level == levelBot {
+		return true
+	}
+
+	key := rec.Level.String() + "\xff" + rec.Message
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	c, ok := h.counters[key]
+	if !ok || rec.Time.Sub(c.start) >= h.window {
+		c = &sampleCounter{start: rec.Time}
+		h.counters[key] = c
+	}
+
+	c.count++
+
+	if c.count <= h.initial {
+		return true
+	}
+
+	return h.thereafter > 0 && (c.count-h.initial)%h.thereafter == 0
+}
+
+// Handle passes sampled record to wrapped handler.
+func (h *samplingHandler) Handle(ctx context.Context, rec slog.Record) error {
+	if !h.sample(rec) {
+		return nil
+	}
+
+	return h.Handler.Handle(ctx, rec)
+}
+
+// WithAttrs returns sampling handler that shares counters.
+func (h *samplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := *h
+	out.Handler = h.Handler.WithAttrs(attrs)
+
+	return &out
+}
+
+// WithGroup returns sampling handler that shares counters.
+func (h *samplingHandler) WithGroup(name string) slog.Handler {
+	out := *h
+	out.Handler = h.Handler.WithGroup(name)
+
+	return &out
+}
+
+// newLogHandler creates JSON or logfmt handler that writes to w.
+func newLogHandler(w io.Writer, format string) slog.Handler {
+	opts := &slog.HandlerOptions{
+		AddSource: cmdDebug,
+		Level:     &logLevel,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) > 0 {
+				return a
+			}
+
+			// anonymize personal data and redact secrets
+			a = anonymizeLogAttr(a)
+
+			switch a.Key {
+			case slog.TimeKey:
+				if !cmdLogDateTime {
+					return slog.Attr{}
+				}
+			case slog.LevelKey:
+				if level, ok := a.Value.Any().(slog.Level); ok {
+					return slog.String(slog.LevelKey, formatLogLevel(level))
+				}
+			case slog.MessageKey:
+				// message is always one of reason messages
+				a.Key = "reason"
+			}
+
+			return a
+		},
+	}
+
+	if format == logFormatLogfmt {
+		return slog.NewTextHandler(w, opts)
+	}
+
+	return slog.NewJSONHandler(w, opts)
+}
+
+// logMessage logs event with key-value pairs, source points to caller of logging helper.
+func logMessage(level slog.Level, reason string, args ...any) {
+	ctx := context.Background()
+
+	if logger == nil || !logger.Enabled(ctx, level) {
+		return
+	}
+
+	var pcs [1]uintptr
+
+	// skip runtime.Callers, logMessage and logging helper
+	runtime.Callers(3, pcs[:])
+
+	rec := slog.NewRecord(time.Now(), level, reason, pcs[0])
+	rec.Add(args...)
+
+	_ = logger.Handler().Handle(ctx, rec)
+}
+
+// logEvent logs request event with status, remote address, host, URI and UA fields.
+func logEvent(level slog.Level, r *http.Request, status int, reason string, args ...any) {
+	logMessage(level, reason, append([]any{
+		"status", status,
+		"remote_addr", r.Header.Get("X-Real-IP"),
+		"host", r.Header.Get("X-Forwarded-Host"),
+		"uri", r.Header.Get("X-Original-URI"),
+		"ua", r.UserAgent(),
+	}, args...)...)
+}
+
+// logBot logs detected automation event and counts it for client address.
+func logBot(status int, reason string, args ...any) {
+	offenders.Add(getBotEventValue(args, "remote_addr"), getBotEventValue(args, "domain"), reason)
+
+	logMessage(levelBot, reason, append([]any{"status", status}, args...)...)
+}
+
+// logInfo logs service event.
+func logInfo(reason string, args ...any) {
+	logMessage(slog.LevelInfo, reason, args...)
+}
+
+// logError logs service error.
+func logError(reason string, err error, args ...any) {
+	logMessage(slog.LevelError, reason, append([]any{"error", err.Error()}, args...)...)
+}
+
+// logFatal logs service error and exits.
+func logFatal(reason string, err error, args ...any) {
+	logMessage(slog.LevelError, reason, append([]any{"error", err.Error()}, args...)...)
+
+	os.Exit(1)
+}
+
+func logLevelHandle(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		b, err := io.ReadAll(io.LimitReader(r.Body, 64))
+		if err != nil {
+			httpError(w, r, messageInvalidRequest, http.StatusBadRequest)
+
+			return
+		}
+
+		level, err := parseLogLevel(strings.TrimSpace(string(b)))
+		if err != nil {
+			httpError(w, r, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		logLevel.Set(level)
+
+		logInfo(messageLogLevel, "new_level", formatLogLevel(level))
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		httpError(w, r, messageOnlyGetOrPostMethod, http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	fmt.Fprintln(w, formatLogLevel(logLevel.Level()))
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
-	"html/template"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"net"
 	"net/http"
 	"os"
@@ -9,79 +12,236 @@ import (
 	"syscall"
 )
 
-func main() {
+// loadResources reads files and prepares templates required to serve requests.
+func loadResources() error {
 	var err error
 
 	// read CAPTCHAs to memory
-	captchaDB, err = readCaptchaDB(cmdDBPath)
-	if err != nil {
-		Error.Fatalf("%s\n", err.Error())
+	if err = loadCaptchaDB(cmdDBPath); err != nil {
+		return err
+	}
+
+	// read widget site secrets
+	if cmdSiteSecretsPath != "" {
+		if err = loadSiteSecrets(cmdSiteSecretsPath); err != nil {
+			return err
+		}
+	}
+
+	// read SSO configuration
+	if cmdSSODomain != "" {
+		ssoSecret, err = readSSOSecret(cmdSSOSecretPath)
+		if err != nil {
+			return err
+		}
+
+		ssoDomains = parseSSODomains(cmdSSODomains)
+	}
+
+	// read per-domain policies
+	if cmdPolicyPath != "" {
+		if err = loadPolicies(cmdPolicyPath); err != nil {
+			return err
+		}
+	}
+
+	// read admin API token
+	if cmdAdminTokenPath != "" {
+		adminToken, err = readAdminToken(cmdAdminTokenPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	// read allowlist
+	if cmdAllowlistPath != "" {
+		if err = loadAllowlist(cmdAllowlistPath); err != nil {
+			return err
+		}
 	}
 
-	// prepare captcha HTML template
-	captchaHTMLTemplate, err = template.New("captcha.html").Parse(captchaHTML)
+	// prepare CAPTCHA generation profiles for escalated difficulty
+	escalatedOptions, err = newEscalatedOptions()
 	if err != nil {
-		Error.Fatalf("captcha service template error: %s\n", err.Error())
+		return err
+	}
+
+	// prepare HTML templates
+	return loadTemplates(cmdTemplatesDir)
+}
+
+func main() {
+	// run admin client against running service and exit
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		os.Exit(runCtl(os.Args[2:]))
+	}
+
+	// read configuration from defaults, config file, environment and flags
+	options, err := configure(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
 	}
 
-	// prepare captcha Lite HTML template
-	captchaLiteTemplate, err = template.New("captcha-lite.html").Parse(captchaLight)
 	if err != nil {
-		Error.Fatalf("captcha service template error: %s\n", err.Error())
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(2)
+	}
+
+	initLoggers()
+
+	// run generate CAPTCHA and exit
+	if cmdGenerate > 0 {
+		if err = generateCapcthaDB(cmdDBPath, cmdGenerate); err != nil {
+			logFatal(messageGenerateFailed, err)
+		}
+
+		os.Exit(0)
+	}
+
+	if err = initState(); err != nil {
+		logFatal(messageStartFailed, err)
+	}
+
+	if err = loadResources(); err != nil {
+		logFatal(messageStartFailed, err)
+	}
+
+	// print effective configuration and exit
+	if cmdCheckConfig {
+		if err = printConfig(os.Stdout, options); err != nil {
+			logFatal(messageStartFailed, err)
+		}
+
+		os.Exit(0)
 	}
 
+	// reload CAPTCHA db, templates, per-domain policies, allowlist and site secrets on SIGHUP
+	go reloadOnSignal()
+
 	// create new HTTP mux and define HTTP routes
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", challengeHandle)
-	mux.HandleFunc("/auth", authHandle)
+	mux.HandleFunc("/", instrumentHandler("challenge", challengeHandle))
+	mux.HandleFunc("/auth", instrumentHandler("auth", traceHandler("auth", authHandle)))
 	mux.HandleFunc("/favicon.ico", faviconHandler)
+	mux.HandleFunc("/captcha-widget/widget.js", widgetScriptHandle)
+	mux.HandleFunc("/captcha-widget/challenge", instrumentHandler("widget-challenge", widgetChallengeHandle))
+	mux.HandleFunc("/captcha-widget/verify", instrumentHandler("widget-verify", widgetVerifyHandle))
+	mux.HandleFunc("/captcha-widget/siteverify", instrumentHandler("siteverify", siteverifyHandle))
+	mux.HandleFunc(ssoStartPath, instrumentHandler("sso-start", ssoStartHandle))
+	mux.HandleFunc(ssoConsumePath, instrumentHandler("sso-consume", ssoConsumeHandle))
 
 	// run DB cleaner to clean expired keys
 	go cleanDB(&db)
 
-	// define net listner for HTTP serve function
-	var nl net.Listener
+	// run failure counters cleaner
+	go cleanFailures(failures)
 
-	switch {
-	case strings.HasPrefix(cmdAddress, "unix:"):
-		// get socket path
-		socket := strings.TrimPrefix(cmdAddress, "unix:")
+	// run bans cleaner
+	go cleanBans(bans)
 
-		// remove old Unix socket
-		if _, err = os.Stat(socket); !os.IsNotExist(err) {
-			if err = syscall.Unlink(socket); err != nil {
-				Error.Fatalf("captcha service socket error: %s\n", err.Error())
-			}
-		}
+	// export spans to trace collector
+	if tracer != nil {
+		go tracer.Run()
+	}
+
+	// deliver events to event sinks
+	if events != nil {
+		events.Start()
+	}
+
+	// run offending address tracker cleaner
+	go cleanOffenders(offenders)
+
+	// write banned addresses to nginx deny list
+	if cmdDenyFile != "" {
+		go writeDenyList(cmdDenyFile, cmdDenyReloadCommand)
+	}
+
+	// run crawler verdicts cleaner
+	if crawlers != nil {
+		go cleanCrawlers(crawlers)
+	}
+
+	// log solve time distributions and active bans on SIGUSR1
+	go logStatsOnSignal()
+
+	srv := &http.Server{Handler: mux}
 
-		// listen on unix socket
-		nl, err = net.Listen("unix", socket)
+	// serve admin endpoints on separate listener
+	var adminSrv *http.Server
+
+	adminCtx, cancelAdmin := context.WithCancel(context.Background())
+	defer cancelAdmin()
+
+	if cmdAdminAddress != "" {
+		al, err := listen(cmdAdminAddress, os.FileMode(0600))
 		if err != nil {
-			Error.Fatalf("captcha service socket error: %s\n", err.Error())
+			logFatal(messageListenFailed, err, "address", cmdAdminAddress)
 		}
 
-		// close unix socket on exit
-		defer func() {
-			if err = nl.Close(); err != nil {
-				Error.Fatalf("captcha service socket error: %s\n", err.Error())
+		adminSrv = newAdminServer(adminCtx)
+
+		go func() {
+			if err := adminSrv.Serve(al); !errors.Is(err, http.ErrServerClosed) {
+				logFatal(messageServeFailed, err, "address", cmdAdminAddress)
 			}
 		}()
+	}
 
-		// change unix socket permissions
-		if err = os.Chmod(socket, os.FileMode(0777)); err != nil {
-			Error.Fatalf("captcha service socket error: %s\n", err.Error())
-		}
-	default:
+	// define net listner for HTTP serve function
+	nl, err := listen(cmdAddress, os.FileMode(0777))
+	if err != nil {
+		logFatal(messageListenFailed, err, "address", cmdAddress)
+	}
+
+	// shut down gracefully on SIGTERM or SIGINT
+	done := make(chan struct{})
+
+	go shutdownOnSignal(done, srv, adminSrv, cancelAdmin)
+
+	// start captcha server, listener is closed on shutdown
+	if err = srv.Serve(nl); !errors.Is(err, http.ErrServerClosed) {
+		logFatal(messageServeFailed, err, "address", cmdAddress)
+	}
+
+	// wait for in-flight requests
+	<-done
+}
+
+// listen creates listener on IP:PORT or on unix socket path prefixed with "unix:".
+func listen(address string, mode os.FileMode) (net.Listener, error) {
+	if !strings.HasPrefix(address, "unix:") {
 		// listen on TCP
-		nl, err = net.Listen("tcp", cmdAddress)
+		nl, err := net.Listen("tcp", address)
 		if err != nil {
-			Error.Fatalf("captcha service TCP error: %s\n", err.Error())
+			return nil, fmt.Errorf("TCP error: %w", err)
+		}
+
+		return nl, nil
+	}
+
+	// get socket path
+	socket := strings.TrimPrefix(address, "unix:")
+
+	// remove old Unix socket
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		if err = syscall.Unlink(socket); err != nil {
+			return nil, fmt.Errorf("socket error: %w", err)
 		}
 	}
 
-	// start captcha server
-	err = http.Serve(nl, mux)
+	// listen on unix socket
+	nl, err := net.Listen("unix", socket)
 	if err != nil {
-		Error.Fatalf("captcha service start error: %s\n", err.Error())
+		return nil, fmt.Errorf("socket error: %w", err)
 	}
+
+	// change unix socket permissions
+	if err = os.Chmod(socket, mode); err != nil {
+		nl.Close()
+
+		return nil, fmt.Errorf("socket error: %w", err)
+	}
+
+	return nl, nil
 }
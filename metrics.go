@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricLabels joins label values into map key.
+func metricLabels(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// formatMetricLabels formats label pairs in Prometheus text format.
+func formatMetricLabels(names, values []string, extra ...string) string {
+	pairs := make([]string, 0, len(names)+len(extra)/2)
+
+	for i, name := range names {
+		pairs = append(pairs, name+"="+strconv.Quote(values[i]))
+	}
+
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"="+strconv.Quote(extra[i+1]))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// counterVec defines Prometheus counter with labels.
+type counterVec struct {
+	mu     sync.Mutex
+	name   string
+	help   string
+	labels []string
+	values map[string]uint64
+}
+
+// newCounterVec creates counter with specified label names.
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]uint64),
+	}
+}
+
+// Inc increments counter for label values.
+func (c *counterVec) Inc(values ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.values[metricLabels(values)]++
+}
+
+// Snapshot returns counter values per joined label values.
+func (c *counterVec) Snapshot() map[string]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	out := make(map[string]uint64, len(c.values))
+
+	for key, val := range c.values {
+		out[key] = val
+	}
+
+	return out
+}
+
+// write writes counter in Prometheus text format.
+func (c *counterVec) write(w *bufio.Writer) {
+	values := c.Snapshot()
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %d\n", c.name, formatMetricLabels(c.labels, strings.Split(key, "\xff")), values[key])
+	}
+}
+
+// histogramVec defines Prometheus histogram with labels.
+type histogramVec struct {
+	mu     sync.Mutex
+	name   string
+	help   string
+	labels []string
+	bounds []float64
+	values map[string]*histogram
+}
+
+// newHistogramVec creates histogram with specified bucket upper bounds and label names.
+func newHistogramVec(name, help string, bounds []float64, labels ...string) *histogramVec {
+	return &histogramVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		bounds: bounds,
+		values: make(map[string]*histogram),
+	}
+}
+
+// With returns histogram for label values.
+func (h *histogramVec) With(values ...string) *histogram {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := metricLabels(values)
+
+	val, ok := h.values[key]
+	if !ok {
+		val = newHistogram(h.bounds...)
+		h.values[key] = val
+	}
+
+	return val
+}
+
+// Observe adds value to histogram for label values.
+func (h *histogramVec) Observe(v float64, values ...string) {
+	h.With(values...).Observe(v)
+}
+
+// write writes histogram in Prometheus text format.
+func (h *histogramVec) write(w *bufio.Writer) {
+	h.mu.Lock()
+
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+
+	values := make(map[string]*histogram, len(h.values))
+	for key, val := range h.values {
+		values[key] = val
+	}
+
+	h.mu.Unlock()
+
+	sort.Strings(keys)
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+
+	for _, key := range keys {
+		labels := strings.Split(key, "\xff")
+		val := values[key]
+
+		val.mu.Lock()
+
+		for i, bound := range val.bounds {
+			fmt.Fprintf(w, "%s_bucket%s %d\n",
+				h.name, formatMetricLabels(h.labels, labels, "le", strconv.FormatFloat(bound, 'f', -1, 64)), val.counts[i],
+			)
+		}
+
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatMetricLabels(h.labels, labels, "le", "+Inf"), val.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatMetricLabels(h.labels, labels), strconv.FormatFloat(val.sum, 'f', -1, 64))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatMetricLabels(h.labels, labels), val.count)
+
+		val.mu.Unlock()
+	}
+}
+
+// writeGauge writes single gauge value in Prometheus text format.
+func writeGauge(w *bufio.Writer, name, help string, values map[string]int, label string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+
+	if label == "" {
+		fmt.Fprintf(w, "%s %d\n", name, values[""])
+
+		return
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %d\n", name, formatMetricLabels([]string{label}, []string{key}), values[key])
+	}
+}
+
+// getRequestDomain returns requested host.
+func getRequestDomain(h http.Header) string {
+	return strings.ToLower(h.Get("X-Forwarded-Host"))
+}
+
+// metricDomainSet limits number of distinct domain labels.
+type metricDomainSet struct {
+	mu     sync.Mutex
+	labels map[string]struct{}
+	limit  int
+}
+
+// newMetricDomainSet creates domain label set with specified limit.
+func newMetricDomainSet(limit int) *metricDomainSet {
+	return &metricDomainSet{
+		labels: make(map[string]struct{}),
+		limit:  limit,
+	}
+}
+
+// Get returns domain label, domains over limit are "other".
+func (s *metricDomainSet) Get(domain string) string {
+	if domain == "" {
+		return metricDomainOther
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.labels[domain]; ok {
+		return domain
+	}
+
+	if len(s.labels) >= s.limit {
+		return metricDomainOther
+	}
+
+	s.labels[domain] = struct{}{}
+
+	return domain
+}
+
+// getMetricDomain returns domain label of requested host, hosts that match
+// wildcard policy pattern are grouped by pattern.
+func getMetricDomain(h http.Header) string {
+	host := getRequestDomain(h)
+
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+
+	if set := policies.Load(); set != nil {
+		if pattern, ok := getPolicyPattern(*set, host); ok && strings.HasPrefix(pattern, "*.") {
+			host = pattern
+		}
+	}
+
+	return metricDomains.Get(host)
+}
+
+// getValidationOutcome maps rejection message to validation outcome label.
+func getValidationOutcome(message string) string {
+	switch message {
+	case messageUnknownChallenge:
+		return "unknown"
+	case messageExpiredChallenge:
+		return "expired"
+	case messageInvalidResponse:
+		return "wrong_answer"
+	case messageFilledHoneypot:
+		return "honeypot"
+	case messageTooFastResponse:
+		return "too_fast"
+	default:
+		return "invalid"
+	}
+}
+
+// countAuthDecision counts authentication decision with its reason.
+func countAuthDecision(r *http.Request, message string) {
+	metricAuthDecisions.Inc(getMetricDomain(r.Header), message)
+
+	setSpanOutcome(r, message)
+}
+
+// countRecords counts active sessions and challenges per type.
+func countRecords() (int, map[string]int) {
+	sessions := 0
+	challenges := make(map[string]int)
+
+	db.Range(func(_, val interface{}) bool {
+		record, ok := val.(captchaDBRecord)
+		if !ok || record.Expires.Before(time.Now()) {
+			return true
+		}
+
+		switch record.Type {
+		case recordTypeSession:
+			sessions++
+		case challengeTypeImage, challengeTypeJS, challengeTypeSlider:
+			challenges[record.Type]++
+		}
+
+		return true
+	})
+
+	return sessions, challenges
+}
+
+// instrumentHandler measures handler latency.
+func instrumentHandler(name string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		h(w, r)
+
+		metricHandlerDuration.Observe(time.Since(start).Seconds(), name)
+	}
+}
+
+func metricsHandle(w http.ResponseWriter, r *http.Request) {
+	sessions, challenges := countRecords()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	bw := bufio.NewWriter(w)
+
+	metricChallengesIssued.write(bw)
+	metricValidations.write(bw)
+	metricAuthDecisions.write(bw)
+
+	writeGauge(bw, "captcha_sessions", "Number of active sessions.", map[string]int{"": sessions}, "")
+	writeGauge(bw, "captcha_challenges", "Number of pending challenges per type.", challenges, "type")
+	writeGauge(bw, "captcha_db_size", "Number of pregenerated CAPTCHAs.", map[string]int{"": len(captchaDB.Load().Keys)}, "")
+	writeGauge(bw, "captcha_bans", "Number of active bans.", map[string]int{"": len(bans.List())}, "")
+
+	solveTimes.write(bw)
+	metricHandlerDuration.write(bw)
+	metricEvents.write(bw)
+
+	if err := bw.Flush(); err != nil {
+		logMessage(
+			slog.LevelDebug, messageFailedHTTPResponse,
+			"status", http.StatusOK,
+			"remote_addr", r.RemoteAddr,
+			"uri", r.URL.Path,
+		)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestGetMetricDomain(t *testing.T) {
+	prevDomains, prevPolicies := metricDomains, policies.Load()
+	t.Cleanup(func() {
+		metricDomains = prevDomains
+		policies.Store(prevPolicies)
+	})
+
+	metricDomains = newMetricDomainSet(3)
+	policies.Store(&policySet{"*.example.com": {}, "*": {}})
+
+	tests := []struct {
+		host  string
+		label string
+	}{
+		{"Example.ORG:8443", "example.org"},
+		{"a.example.com", "*.example.com"},
+		{"b.example.com", "*.example.com"},
+		{"example.net", "example.net"},
+		{"", metricDomainOther},
+		// distinct labels over limit
+		{"random.invalid", metricDomainOther},
+		{"example.org", "example.org"},
+	}
+
+	for _, tt := range tests {
+		h := make(http.Header)
+		h.Set("X-Forwarded-Host", tt.host)
+
+		if got := getMetricDomain(h); got != tt.label {
+			t.Errorf("getMetricDomain(%q) = %q, want %q", tt.host, got, tt.label)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// duration is time.Duration that is JSON encoded as string, like "60s".
+type duration time.Duration
+
+// UnmarshalJSON decodes duration from JSON string.
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = duration(v)
+
+	return nil
+}
+
+// MarshalJSON encodes duration as JSON string.
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// domainPolicy defines per-domain behaviour, empty values fall back to defaults and configuration headers.
+type domainPolicy struct {
+	// AuthTTL defines authentication cookie expiration
+	AuthTTL duration `json:"auth_ttl,omitempty"`
+	// ChallengeTTL defines challenge expiration
+	ChallengeTTL duration `json:"challenge_ttl,omitempty"`
+	// CookieScope defines authentication cookie domain, "host" or "tldplusone"
+	CookieScope string `json:"cookie_scope,omitempty"`
+	// ChallengeType defines challenge type, "image", "js" or "slider"
+	ChallengeType string `json:"challenge_type,omitempty"`
+	// Template defines captcha template, "full" or "lite"
+	Template string `json:"template,omitempty"`
+	// ExemptPaths defines URI paths that do not require authentication together with paths below them
+	ExemptPaths []string `json:"exempt_paths,omitempty"`
+	// BindUserAgent defines that session is valid only for UA that solved challenge, enabled by default
+	BindUserAgent *bool `json:"bind_user_agent,omitempty"`
+	// BindAddress defines that session is valid only for address that solved challenge, disabled by default
+	BindAddress *bool `json:"bind_address,omitempty"`
+}
+
+// policySet maps host patterns to policies, pattern is exact host, "*.domain" or "*".
+type policySet map[string]domainPolicy
+
+// getAuthTTL returns authentication cookie expiration.
+func (p domainPolicy) getAuthTTL() time.Duration {
+	if p.AuthTTL > 0 {
+		return time.Duration(p.AuthTTL)
+	}
+
+	return time.Duration(authenticationExpirationSeconds * nanoSecondsInSecond)
+}
+
+// getChallengeTTL returns challenge expiration.
+func (p domainPolicy) getChallengeTTL() time.Duration {
+	if p.ChallengeTTL > 0 {
+		return time.Duration(p.ChallengeTTL)
+	}
+
+	return time.Duration(challengeExpirationSeconds * nanoSecondsInSecond)
+}
+
+// isUserAgentBound checks that session is valid only for UA that solved challenge.
+func (p domainPolicy) isUserAgentBound() bool {
+	return p.BindUserAgent == nil || *p.BindUserAgent
+}
+
+// isAddressBound checks that session is valid only for address that solved challenge.
+func (p domainPolicy) isAddressBound() bool {
+	return p.BindAddress != nil && *p.BindAddress
+}
+
+// getExemptPath returns decoded and cleaned URI path, URI with dot segments is rejected
+// as nginx normalizes it to different path after authentication.
+func getExemptPath(uri string) (string, bool) {
+	raw, _, _ := strings.Cut(uri, "?")
+
+	decoded, err := url.PathUnescape(raw)
+	if err != nil || !strings.HasPrefix(decoded, "/") {
+		return "", false
+	}
+
+	for _, segment := range strings.Split(decoded, "/") {
+		if segment == "." || segment == ".." {
+			return "", false
+		}
+	}
+
+	return path.Clean(decoded), true
+}
+
+// isExemptPath checks that URI path does not require authentication,
+// path matches exempt path exactly or is below it.
+func (p domainPolicy) isExemptPath(uri string) bool {
+	cleaned, ok := getExemptPath(uri)
+	if !ok {
+		return false
+	}
+
+	for _, exempt := range p.ExemptPaths {
+		exempt = strings.TrimSuffix(exempt, "/")
+
+		if cleaned == exempt || strings.HasPrefix(cleaned, exempt+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validate checks policy values.
+func (p domainPolicy) validate() error {
+	if p.AuthTTL < 0 || p.ChallengeTTL < 0 {
+		return errors.New("negative TTL")
+	}
+
+	if p.ChallengeTTL > 0 && time.Duration(p.ChallengeTTL) <= cmdMinSolveTime {
+		return errors.New("challenge TTL must be longer than minimal solve time")
+	}
+
+	switch p.CookieScope {
+	case "", cookieScopeHost, cookieScopeTLDPlusOne:
+	default:
+		return fmt.Errorf("unknown cookie scope '%s'", p.CookieScope)
+	}
+
+	switch p.ChallengeType {
+	case "", challengeTypeImage, challengeTypeJS, challengeTypeSlider:
+	default:
+		return fmt.Errorf("unknown challenge type '%s'", p.ChallengeType)
+	}
+
+	switch p.Template {
+	case "", templateFull, templateLite:
+	default:
+		return fmt.Errorf("unknown template '%s'", p.Template)
+	}
+
+	for _, prefix := range p.ExemptPaths {
+		if !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("exempt path '%s' must start with '/'", prefix)
+		}
+	}
+
+	return nil
+}
+
+// readPolicies loads and validates JSON policy file.
+func readPolicies(path string) (policySet, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("policy error: %w", err)
+	}
+
+	var set policySet
+
+	if err = json.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("policy error: %w", err)
+	}
+
+	out := make(policySet, len(set))
+
+	for pattern, p := range set {
+		key := strings.ToLower(pattern)
+
+		if key != "*" && strings.Contains(strings.TrimPrefix(key, "*."), "*") {
+			return nil, fmt.Errorf("policy error: invalid host pattern '%s'", pattern)
+		}
+
+		if err = p.validate(); err != nil {
+			return nil, fmt.Errorf("policy error: '%s': %w", pattern, err)
+		}
+
+		out[key] = p
+	}
+
+	return out, nil
+}
+
+// getPolicyPattern returns most specific policy pattern that matches host.
+func getPolicyPattern(set policySet, host string) (string, bool) {
+	host = strings.ToLower(host)
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	if _, ok := set[host]; ok {
+		return host, true
+	}
+
+	// walk up wildcard patterns, "*.b.c" then "*.c"
+	for name := host; ; {
+		_, parent, ok := strings.Cut(name, ".")
+		if !ok {
+			break
+		}
+
+		if _, ok := set["*."+parent]; ok {
+			return "*." + parent, true
+		}
+
+		name = parent
+	}
+
+	_, ok := set["*"]
+
+	return "*", ok
+}
+
+// getPolicy returns policy for host, most specific pattern wins.
+func getPolicy(host string) domainPolicy {
+	set := policies.Load()
+	if set == nil {
+		return domainPolicy{}
+	}
+
+	pattern, ok := getPolicyPattern(*set, host)
+	if !ok {
+		return domainPolicy{}
+	}
+
+	return (*set)[pattern]
+}
+
+// loadPolicies reads policy file and replaces active policies.
+func loadPolicies(path string) error {
+	set, err := readPolicies(path)
+	if err != nil {
+		return err
+	}
+
+	policies.Store(&set)
+
+	return nil
+}
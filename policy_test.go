@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestIsExemptPath(t *testing.T) {
+	p := domainPolicy{ExemptPaths: []string{"/robots.txt", "/.well-known/"}}
+
+	tests := []struct {
+		uri    string
+		exempt bool
+	}{
+		{"/robots.txt", true},
+		{"/robots.txt?x=1", true},
+		{"/.well-known/", true},
+		{"/.well-known", true},
+		{"/.well-known/acme-challenge/token", true},
+		{"/.well-known//acme-challenge/token", true},
+		{"/%2ewell-known/acme-challenge/token", true},
+		{"/robots.txtanything", false},
+		{"/robots.txt/../admin", false},
+		{"/.well-knownx/admin", false},
+		{"/.well-known/../admin", false},
+		{"/.well-known/./../admin", false},
+		{"/.well-known/%2e%2e/admin", false},
+		{"/.well-known/%2E%2E/admin", false},
+		{"/.well-known%2f..%2fadmin", false},
+		{"/.well-known/%2e/acme-challenge", false},
+		{"/.well-known/%zz", false},
+		{"/admin?/.well-known/", false},
+		{"/admin", false},
+		{"", false},
+		{"robots.txt", false},
+	}
+
+	for _, tt := range tests {
+		if got := p.isExemptPath(tt.uri); got != tt.exempt {
+			t.Errorf("isExemptPath(%q) = %v, want %v", tt.uri, got, tt.exempt)
+		}
+	}
+}
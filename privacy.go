@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// readPrivacyKey reads keyed hashing key file, empty path generates random key that is valid until restart.
+func readPrivacyKey(path string) ([]byte, error) {
+	if path == "" {
+		key := make([]byte, 32)
+
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("privacy key error: %w", err)
+		}
+
+		return key, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("privacy key error: %w", err)
+	}
+
+	key := []byte(strings.TrimSpace(string(b)))
+	if len(key) < 32 {
+		return nil, fmt.Errorf("privacy key error: key must be at least 32 bytes long")
+	}
+
+	return key, nil
+}
+
+// getKeyedHash returns truncated keyed hash of value, it correlates values without revealing them.
+func getKeyedHash(value string) string {
+	mac := hmac.New(sha256.New, privacyKey)
+	mac.Write([]byte(value))
+
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// truncateAddress zeroes host part of address, /24 for IPv4 and /48 for IPv6.
+func truncateAddress(address string) string {
+	addr, err := netip.ParseAddr(address)
+	if err != nil {
+		return address
+	}
+
+	addr = addr.Unmap()
+
+	bits := privacyPrefixBitsIPv6
+	if addr.Is4() {
+		bits = privacyPrefixBitsIPv4
+	}
+
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return address
+	}
+
+	return prefix.Addr().String()
+}
+
+// anonymizeAddress returns address according to address privacy mode.
+func anonymizeAddress(address string) string {
+	// skip empty and already hashed values
+	if address == "" || strings.HasPrefix(address, "h:") {
+		return address
+	}
+
+	switch cmdPrivacyAddress {
+	case privacyModeTruncate:
+		return truncateAddress(address)
+	case privacyModeHash:
+		return "h:" + getKeyedHash(address)
+	default:
+		return address
+	}
+}
+
+// anonymizeUserAgent returns UA according to UA privacy mode.
+func anonymizeUserAgent(ua string) string {
+	// skip empty and already hashed values
+	if ua == "" || strings.HasPrefix(ua, "h:") {
+		return ua
+	}
+
+	switch cmdPrivacyUserAgent {
+	case privacyModeHash:
+		return "h:" + getKeyedHash(strings.ToLower(ua))
+	case privacyModeOmit:
+		return ""
+	default:
+		return ua
+	}
+}
+
+// redactSecret returns keyed hash fingerprint of cookie ID, token or response when redaction is enabled.
+func redactSecret(value string) string {
+	if !cmdPrivacyRedact || value == "" {
+		return value
+	}
+
+	return "redacted:" + getKeyedHash(value)
+}
+
+// anonymizeLogAttr applies privacy mode to log attribute with personal or secret value.
+func anonymizeLogAttr(a slog.Attr) slog.Attr {
+	if a.Value.Kind() != slog.KindString {
+		return a
+	}
+
+	switch a.Key {
+	case "remote_addr", "ban":
+		// ban key is address or network prefix, prefixes are already anonymous
+		if !strings.Contains(a.Value.String(), "/") {
+			return slog.String(a.Key, anonymizeAddress(a.Value.String()))
+		}
+	case "expected_addr", "ip":
+		return slog.String(a.Key, anonymizeAddress(a.Value.String()))
+	case "ua", "expected_ua":
+		return slog.String(a.Key, anonymizeUserAgent(a.Value.String()))
+	case "auth_id", "token", "response", "nonce":
+		return slog.String(a.Key, redactSecret(a.Value.String()))
+	}
+
+	return a
+}
+
+// getRecordAddress returns address stored in db record according to record retention mode.
+func getRecordAddress(address string) string {
+	switch cmdPrivacyRecords {
+	case privacyRecordsAnonymized:
+		if cmdPrivacyAddress == privacyModeTruncate {
+			return truncateAddress(address)
+		}
+
+		return "h:" + getKeyedHash(address)
+	case privacyRecordsMinimal:
+		return ""
+	default:
+		return address
+	}
+}
+
+// getRecordBanKey returns key that unsolved challenge in db record counts towards,
+// anonymized and minimal records keep only network prefix which is anonymous already.
+func getRecordBanKey(address string) string {
+	if cmdPrivacyRecords == privacyRecordsFull {
+		return address
+	}
+
+	_, prefix, ok := getAddressPrefix(address)
+	if !ok {
+		return ""
+	}
+
+	return prefix
+}
+
+// getRecordUserAgent returns UA stored in db record according to record retention mode.
+func getRecordUserAgent(ua string) string {
+	switch cmdPrivacyRecords {
+	case privacyRecordsAnonymized:
+		// UA binding requires comparable value, hash is stored regardless of UA log mode
+		return "h:" + getKeyedHash(strings.ToLower(ua))
+	case privacyRecordsMinimal:
+		return ""
+	default:
+		return ua
+	}
+}
+
+// isRecordAddress checks that request address matches address stored in db record,
+// minimal record retention does not store address and disables address binding.
+func isRecordAddress(stored, address string) bool {
+	if cmdPrivacyRecords == privacyRecordsMinimal {
+		return true
+	}
+
+	return stored == getRecordAddress(address)
+}
+
+// isRecordUserAgent checks that request UA matches UA stored in db record,
+// minimal record retention does not store UA and disables UA binding.
+func isRecordUserAgent(stored, ua string) bool {
+	switch cmdPrivacyRecords {
+	case privacyRecordsMinimal:
+		return true
+	case privacyRecordsAnonymized:
+		return stored == getRecordUserAgent(ua)
+	default:
+		return strings.EqualFold(stored, ua)
+	}
+}
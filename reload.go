@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+)
+
+// templateSet groups HTML templates, set is replaced as whole on reload.
+type templateSet struct {
+	HTML   *template.Template
+	Lite   *template.Template
+	JS     *template.Template
+	Slider *template.Template
+	SSO    *template.Template
+}
+
+// loadTemplates parses HTML templates and replaces active templates, previous templates stay active on error,
+// template file with same name in dir overrides built-in template.
+func loadTemplates(dir string) error {
+	set := new(templateSet)
+
+	for _, t := range []struct {
+		out  **template.Template
+		name string
+		text string
+	}{
+		{&set.HTML, "captcha.html", captchaHTML},
+		{&set.Lite, "captcha-lite.html", captchaLight},
+		{&set.JS, "captcha-js.html", captchaJS},
+		{&set.Slider, "captcha-slider.html", captchaSlider},
+		{&set.SSO, "captcha-sso.html", captchaSSO},
+	} {
+		text := t.text
+
+		if dir != "" {
+			b, err := os.ReadFile(filepath.Join(dir, t.name))
+
+			switch {
+			case err == nil:
+				text = string(b)
+			case !errors.Is(err, os.ErrNotExist):
+				return fmt.Errorf("captcha service template error: %w", err)
+			}
+		}
+
+		var err error
+
+		*t.out, err = template.New(t.name).Parse(text)
+		if err != nil {
+			return fmt.Errorf("captcha service template error: %w", err)
+		}
+	}
+
+	templates.Store(set)
+
+	return nil
+}
+
+// reloadResources reloads CAPTCHA db, HTML templates, per-domain policies, allowlist and site secrets,
+// each resource that fails to reload keeps its previous state.
+func reloadResources() error {
+	var errs []error
+
+	for _, f := range []struct {
+		path     string
+		optional bool
+		load     func(string) error
+	}{
+		{cmdDBPath, false, loadCaptchaDB},
+		{cmdTemplatesDir, false, loadTemplates},
+		{cmdPolicyPath, true, loadPolicies},
+		{cmdAllowlistPath, true, loadAllowlist},
+		{cmdSiteSecretsPath, true, loadSiteSecrets},
+	} {
+		if f.optional && f.path == "" {
+			continue
+		}
+
+		if err := f.load(f.path); err != nil {
+			logError(messageReloadFailed, err, "path", f.path)
+
+			errs = append(errs, err)
+
+			continue
+		}
+
+		logInfo(messageReloaded, "path", f.path)
+	}
+
+	return errors.Join(errs...)
+}
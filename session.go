@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// storeSession generates authentication ID and stores session record to db.
+func storeSession(domain, ua, address string, ttl time.Duration) (string, time.Time, error) {
+	// generate ID for cookie value
+	id, err := genUUID()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	// generate issue and expire dates for authentication hash
+	issued := time.Now()
+	expires := issued.Add(ttl)
+
+	// store session to db
+	db.Store(id,
+		captchaDBRecord{
+			Type: recordTypeSession,
+
+			Domain:    domain,
+			UserAgent: getRecordUserAgent(ua),
+			Issued:    issued,
+			Expires:   expires,
+
+			Address: getRecordAddress(address),
+		},
+	)
+
+	return id, expires, nil
+}
+
+// newSession generates authentication ID, stores session record to db and sets authentication cookie.
+func newSession(w http.ResponseWriter, r *http.Request, domain string, ttl time.Duration) (string, time.Time, error) {
+	start := time.Now()
+
+	id, expires, err := storeSession(domain, r.UserAgent(), r.Header.Get("X-Real-IP"), ttl)
+	observeStore(r, start)
+
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	// set cookie for wildcard domain cookie, domain starts with '.'
+	if strings.HasPrefix(domain, ".") {
+		http.SetCookie(w, &http.Cookie{
+			Domain:   domain,
+			Name:     authenticationName,
+			Value:    id,
+			Expires:  expires,
+			MaxAge:   int(expires.Unix() - time.Now().Unix()),
+			Secure:   isHTTPS(r.Header),
+			HttpOnly: false,
+			SameSite: http.SameSiteNoneMode,
+		})
+	} else { // non-wildcard cookie
+		sameSite := http.SameSiteStrictMode
+
+		// central SSO domain cookie must be sent on cross-site redirects from other domains
+		if isSSOEnabled() && strings.EqualFold(domain, cmdSSODomain) {
+			sameSite = http.SameSiteLaxMode
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     authenticationName,
+			Value:    id,
+			Expires:  expires,
+			MaxAge:   int(expires.Unix() - time.Now().Unix()),
+			Secure:   isHTTPS(r.Header),
+			HttpOnly: true,
+			SameSite: sameSite,
+		})
+	}
+
+	return id, expires, nil
+}
+
+// isValidSession checks that request carries valid authentication cookie for domain.
+func isValidSession(r *http.Request, domain string) bool {
+	auth, err := r.Cookie(authenticationName)
+	if err != nil || auth == nil {
+		return false
+	}
+
+	val, ok := db.Load(auth.Value)
+	if !ok {
+		return false
+	}
+
+	record, ok := val.(captchaDBRecord)
+	if !ok {
+		return false
+	}
+
+	return record.Type == recordTypeSession &&
+		strings.EqualFold(domain, record.Domain) &&
+		isRecordUserAgent(record.UserAgent, r.UserAgent()) &&
+		record.Expires.After(time.Now())
+}
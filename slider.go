@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"strconv"
+	"strings"
+)
+
+// sliderPuzzle contains generated slider puzzle images.
+type sliderPuzzle struct {
+	// Background is base64 encoded JPEG with piece cut out
+	Background string
+	// Piece is base64 encoded PNG of cut out piece
+	Piece string
+
+	// Width defines background width
+	Width int
+	// X defines horizontal piece offset, it is puzzle solution
+	X int
+	// Y defines vertical piece offset
+	Y int
+}
+
+// sliderPoint defines single point of slider movement trajectory.
+type sliderPoint struct {
+	// T defines milliseconds since movement start
+	T int
+	// X defines slider position
+	X int
+}
+
+// newSliderPuzzle cuts piece out of base64 encoded JPEG background at random offset.
+func newSliderPuzzle(b64str string) (sliderPuzzle, error) {
+	raw, err := base64.StdEncoding.DecodeString(b64str)
+	if err != nil {
+		return sliderPuzzle{}, fmt.Errorf("slider puzzle error: %w", err)
+	}
+
+	src, err := jpeg.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return sliderPuzzle{}, fmt.Errorf("slider puzzle error: %w", err)
+	}
+
+	bounds := src.Bounds()
+
+	if bounds.Dx() < 3*sliderPieceSize || bounds.Dy() < sliderPieceSize {
+		return sliderPuzzle{}, fmt.Errorf("slider puzzle error: background is too small")
+	}
+
+	nx, err := getRandomUint32()
+	if err != nil {
+		return sliderPuzzle{}, fmt.Errorf("slider puzzle error: %w", err)
+	}
+
+	ny, err := getRandomUint32()
+	if err != nil {
+		return sliderPuzzle{}, fmt.Errorf("slider puzzle error: %w", err)
+	}
+
+	// piece is never placed near slider start position
+	x := sliderPieceSize + int(nx%uint32(bounds.Dx()-2*sliderPieceSize+1))
+	y := int(ny % uint32(bounds.Dy()-sliderPieceSize+1))
+
+	rect := image.Rect(x, y, x+sliderPieceSize, y+sliderPieceSize).Add(bounds.Min)
+
+	piece := image.NewRGBA(image.Rect(0, 0, sliderPieceSize, sliderPieceSize))
+	draw.Draw(piece, piece.Bounds(), src, rect.Min, draw.Src)
+
+	background := image.NewRGBA(bounds)
+	draw.Draw(background, bounds, src, bounds.Min, draw.Src)
+	draw.Draw(background, rect, image.NewUniform(color.RGBA{A: 160}), image.Point{}, draw.Over)
+
+	var bgBuff, pieceBuff bytes.Buffer
+
+	if err = jpeg.Encode(&bgBuff, background, nil); err != nil {
+		return sliderPuzzle{}, fmt.Errorf("slider puzzle error: %w", err)
+	}
+
+	if err = png.Encode(&pieceBuff, piece); err != nil {
+		return sliderPuzzle{}, fmt.Errorf("slider puzzle error: %w", err)
+	}
+
+	return sliderPuzzle{
+		Background: base64.StdEncoding.EncodeToString(bgBuff.Bytes()),
+		Piece:      base64.StdEncoding.EncodeToString(pieceBuff.Bytes()),
+		Width:      bounds.Dx(),
+		X:          x,
+		Y:          y,
+	}, nil
+}
+
+// parseSliderTrajectory parses trajectory in "T:X,T:X" format.
+func parseSliderTrajectory(value string) ([]sliderPoint, error) {
+	fields := strings.Split(value, ",")
+
+	if len(fields) > sliderMaxTrajectoryPoints {
+		return nil, fmt.Errorf("slider trajectory error: too many points")
+	}
+
+	points := make([]sliderPoint, 0, len(fields))
+
+	for _, field := range fields {
+		t, x, ok := strings.Cut(field, ":")
+		if !ok {
+			return nil, fmt.Errorf("slider trajectory error: invalid point")
+		}
+
+		var (
+			p   sliderPoint
+			err error
+		)
+
+		if p.T, err = strconv.Atoi(t); err != nil {
+			return nil, fmt.Errorf("slider trajectory error: %w", err)
+		}
+
+		if p.X, err = strconv.Atoi(x); err != nil {
+			return nil, fmt.Errorf("slider trajectory error: %w", err)
+		}
+
+		points = append(points, p)
+	}
+
+	return points, nil
+}
+
+// isValidSliderResponse checks submitted slider offset and basic properties of movement trajectory.
+func isValidSliderResponse(offset int, response, trajectory string) bool {
+	x, err := strconv.Atoi(response)
+	if err != nil {
+		return false
+	}
+
+	// check offset within tolerance
+	if x < offset-sliderTolerancePixels || x > offset+sliderTolerancePixels {
+		return false
+	}
+
+	points, err := parseSliderTrajectory(trajectory)
+	if err != nil || len(points) < sliderMinTrajectoryPoints {
+		return false
+	}
+
+	// trajectory must end at submitted offset
+	if points[len(points)-1].X != x {
+		return false
+	}
+
+	// movement must not be instant
+	if points[len(points)-1].T-points[0].T < sliderMinMovementMilliseconds {
+		return false
+	}
+
+	// time must go forward and movement must not be perfectly uniform
+	uniform := true
+
+	for i := 1; i < len(points); i++ {
+		if points[i].T < points[i-1].T {
+			return false
+		}
+
+		if i > 1 && (points[i].X-points[i-1].X != points[1].X-points[0].X ||
+			points[i].T-points[i-1].T != points[1].T-points[0].T) {
+			uniform = false
+		}
+	}
+
+	return !uniform
+}
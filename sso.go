@@ -0,0 +1,344 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// ssoAssertion defines signed short-lived proof of session solved on central SSO domain.
+type ssoAssertion struct {
+	// Audience defines domain that may exchange assertion
+	Audience string `json:"aud"`
+	// Expires defines assertion expiration as unix time
+	Expires int64 `json:"exp"`
+	// Nonce makes assertion single-use
+	Nonce string `json:"nonce"`
+	// UserAgent stores hash of UA that assertion was issued to
+	UserAgent string `json:"ua"`
+}
+
+// readSSOSecret reads HMAC key for SSO assertions from file.
+func readSSOSecret(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("sso secret error: %w", err)
+	}
+
+	secret := []byte(strings.TrimSpace(string(b)))
+	if len(secret) < 32 {
+		return nil, fmt.Errorf("sso secret error: secret must be at least 32 bytes long")
+	}
+
+	return secret, nil
+}
+
+// parseSSODomains parses comma separated list of domains allowed to take part in SSO.
+func parseSSODomains(value string) map[string]bool {
+	domains := make(map[string]bool)
+
+	for _, domain := range strings.Split(value, ",") {
+		if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+			domains[domain] = true
+		}
+	}
+
+	return domains
+}
+
+// isSSOEnabled checks that SSO is configured.
+func isSSOEnabled() bool {
+	return cmdSSODomain != "" && len(ssoSecret) > 0
+}
+
+// signSSOAssertion encodes and signs SSO assertion.
+func signSSOAssertion(a ssoAssertion) (string, error) {
+	b, err := json.Marshal(a)
+	if err != nil {
+		return "", fmt.Errorf("sso assertion error: %w", err)
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(b)
+
+	mac := hmac.New(sha256.New, ssoSecret)
+	mac.Write([]byte(payload))
+
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// verifySSOAssertion checks SSO assertion signature and decodes it.
+func verifySSOAssertion(value string) (ssoAssertion, error) {
+	var a ssoAssertion
+
+	payload, signature, ok := strings.Cut(value, ".")
+	if !ok {
+		return a, errors.New("sso assertion error: invalid format")
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return a, fmt.Errorf("sso assertion error: %w", err)
+	}
+
+	mac := hmac.New(sha256.New, ssoSecret)
+	mac.Write([]byte(payload))
+
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return a, errors.New("sso assertion error: invalid signature")
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return a, fmt.Errorf("sso assertion error: %w", err)
+	}
+
+	if err = json.Unmarshal(b, &a); err != nil {
+		return a, fmt.Errorf("sso assertion error: %w", err)
+	}
+
+	return a, nil
+}
+
+// getScheme returns URL scheme of original request.
+func getScheme(h http.Header) string {
+	if isHTTPS(h) {
+		return "https"
+	}
+
+	return "http"
+}
+
+// getSSOStartURL returns central SSO domain URL when request should be redirected there.
+func getSSOStartURL(r *http.Request) (string, bool) {
+	host := strings.ToLower(r.Header.Get("X-Forwarded-Host"))
+
+	if !isSSOEnabled() || !ssoDomains[host] || strings.EqualFold(host, cmdSSODomain) {
+		return "", false
+	}
+
+	// previous SSO handshake failed, solve captcha locally
+	if _, err := r.Cookie(ssoFailedName); err == nil {
+		return "", false
+	}
+
+	back := url.URL{
+		Scheme: getScheme(r.Header),
+		Host:   host,
+		Path:   "/",
+	}
+
+	// keep originally requested URI
+	if u, err := url.ParseRequestURI(getReturnURI(r.Header.Get("X-Original-URI"))); err == nil {
+		back.Path = u.Path
+		back.RawQuery = u.RawQuery
+	}
+
+	start := url.URL{
+		Scheme:   getScheme(r.Header),
+		Host:     cmdSSODomain,
+		Path:     ssoStartPath,
+		RawQuery: url.Values{"return": {back.String()}}.Encode(),
+	}
+
+	return start.String(), true
+}
+
+func ssoStartHandle(w http.ResponseWriter, r *http.Request) {
+	if !isSSOEnabled() || !strings.EqualFold(r.Header.Get("X-Forwarded-Host"), cmdSSODomain) {
+		logEvent(slog.LevelDebug, r, http.StatusNotFound, messageSSODisabled)
+
+		httpError(w, r, messageSSODisabled, http.StatusNotFound)
+
+		return
+	}
+
+	// define domain for a cookie
+	domain := getCookieDomain(r.Header)
+
+	// session on central domain is required, nginx auth_request is expected to protect this location
+	if !isValidSession(r, domain) {
+		logEvent(
+			slog.LevelInfo, r, unAuthorizedAccess, messageUnknownAuthentication,
+			"domain", domain,
+		)
+
+		httpError(w, r, messageUnknownAuthentication, unAuthorizedAccess)
+
+		return
+	}
+
+	// return URL must point to allowed domain
+	back, err := url.Parse(r.URL.Query().Get("return"))
+	if err != nil || (back.Scheme != "http" && back.Scheme != "https") ||
+		back.User != nil || !ssoDomains[strings.ToLower(back.Host)] {
+		logEvent(
+			slog.LevelInfo, r, http.StatusForbidden, messageForbiddenSSODomain,
+			"domain", domain,
+		)
+
+		httpError(w, r, messageForbiddenSSODomain, http.StatusForbidden)
+
+		return
+	}
+
+	nonce, err := genUUID()
+	if err != nil {
+		logEvent(
+			slog.LevelError, r, http.StatusInternalServerError, messageFailedEntropy,
+			"domain", domain,
+		)
+
+		httpError(w, r, messageFailedEntropy, http.StatusInternalServerError)
+
+		return
+	}
+
+	assertion, err := signSSOAssertion(ssoAssertion{
+		Audience:  strings.ToLower(back.Host),
+		Expires:   time.Now().Add(time.Duration(ssoAssertionExpirationSeconds * nanoSecondsInSecond)).Unix(),
+		Nonce:     nonce,
+		UserAgent: getStringHash(r.UserAgent()),
+	})
+	if err != nil {
+		logEvent(
+			slog.LevelError, r, http.StatusInternalServerError, messageInvalidSSOAssertion,
+			"domain", domain,
+			"error", err.Error(),
+		)
+
+		httpError(w, r, messageInvalidSSOAssertion, http.StatusInternalServerError)
+
+		return
+	}
+
+	consume := url.URL{
+		Scheme: back.Scheme,
+		Host:   back.Host,
+		Path:   ssoConsumePath,
+		RawQuery: url.Values{
+			"assertion": {assertion},
+			"return":    {back.RequestURI()},
+		}.Encode(),
+	}
+
+	logEvent(
+		slog.LevelInfo, r, http.StatusSeeOther, messageSSOAssertion,
+		"domain", domain,
+		"audience", back.Host,
+	)
+
+	http.Redirect(w, r, consume.String(), http.StatusSeeOther)
+}
+
+// rejectSSOAssertion marks failed SSO handshake and redirects to originally requested URI.
+func rejectSSOAssertion(w http.ResponseWriter, r *http.Request, uri, reason string) {
+	logEvent(
+		slog.LevelInfo, r, http.StatusSeeOther, messageInvalidSSOAssertion,
+		"detail", reason,
+	)
+
+	// prevent redirect loop, next challenge is solved locally
+	http.SetCookie(w, &http.Cookie{
+		Name:     ssoFailedName,
+		Value:    "1",
+		Expires:  time.Now().Add(time.Duration(fallbackExpirationSeconds * nanoSecondsInSecond)),
+		MaxAge:   fallbackExpirationSeconds,
+		Secure:   isHTTPS(r.Header),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, getReturnURI(uri), http.StatusSeeOther)
+}
+
+func ssoConsumeHandle(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	host := strings.ToLower(r.Header.Get("X-Forwarded-Host"))
+
+	if !isSSOEnabled() || !ssoDomains[host] {
+		rejectSSOAssertion(w, r, query.Get("return"), messageSSODisabled)
+
+		return
+	}
+
+	a, err := verifySSOAssertion(query.Get("assertion"))
+	if err != nil {
+		rejectSSOAssertion(w, r, query.Get("return"), err.Error())
+
+		return
+	}
+
+	switch {
+	case a.Audience != host:
+		rejectSSOAssertion(w, r, query.Get("return"), "audience mismatch")
+
+		return
+	case time.Now().Unix() > a.Expires:
+		rejectSSOAssertion(w, r, query.Get("return"), "expired")
+
+		return
+	case a.UserAgent != getStringHash(r.UserAgent()):
+		rejectSSOAssertion(w, r, query.Get("return"), "user-agent mismatch")
+
+		return
+	}
+
+	// nonce is stored until assertion expires, so that assertion can not be replayed
+	if _, loaded := db.LoadOrStore(a.Nonce, captchaDBRecord{
+		Type:    recordTypeSSONonce,
+		Domain:  host,
+		Issued:  time.Now(),
+		Expires: time.Unix(a.Expires, 0),
+	}); loaded {
+		rejectSSOAssertion(w, r, query.Get("return"), "replayed")
+
+		return
+	}
+
+	// define domain for a cookie
+	domain := getCookieDomain(r.Header)
+
+	// set how long cookie is valid
+	authenticationTTL := getPolicy(r.Header.Get("X-Forwarded-Host")).getAuthTTL()
+
+	// create local session and set authentication cookie
+	id, _, err := newSession(w, r, domain, authenticationTTL)
+	if err != nil {
+		logEvent(
+			slog.LevelError, r, http.StatusInternalServerError, messageFailedEntropy,
+			"domain", domain,
+		)
+
+		httpError(w, r, messageFailedEntropy, http.StatusInternalServerError)
+
+		return
+	}
+
+	logEvent(
+		slog.LevelInfo, r, http.StatusOK, messageSSOSession,
+		"domain", domain,
+		"auth_id", id,
+		"ttl", authenticationTTL.String(),
+	)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	// render same-site redirect page
+	if err = templates.Load().SSO.Execute(w, struct{ URI string }{
+		URI: getReturnURI(query.Get("return")),
+	}); err != nil {
+		logEvent(
+			slog.LevelError, r, http.StatusInternalServerError, messageFailedHTMLRender,
+			"domain", domain,
+		)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// histogram counts observations in cumulative buckets.
+type histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// newHistogram creates histogram with specified ascending bucket upper bounds.
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)),
+	}
+}
+
+// Observe adds value to histogram.
+func (h *histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+
+	h.sum += v
+	h.count++
+}
+
+// String returns histogram in "le=BOUND:COUNT ... sum=SUM count=COUNT" format.
+func (h *histogram) String() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fields := make([]string, 0, len(h.bounds)+2)
+
+	for i, bound := range h.bounds {
+		fields = append(fields, fmt.Sprintf("le=%s:%d", strconv.FormatFloat(bound, 'f', -1, 64), h.counts[i]))
+	}
+
+	fields = append(fields,
+		fmt.Sprintf("sum=%.3f", h.sum),
+		fmt.Sprintf("count=%d", h.count),
+	)
+
+	return strings.Join(fields, " ")
+}
+
+// newSolveTimes creates solve time histograms, in seconds, labelled with challenge type.
+func newSolveTimes() *histogramVec {
+	return newHistogramVec(
+		"captcha_solve_time_seconds", "Time between challenge render and response.",
+		[]float64{0.25, 0.5, 1, 2, 3, 5, 10, 20, 30, 60}, "type",
+	)
+}
+
+// logStatsOnSignal logs solve time distributions and active bans each time SIGUSR1 is received.
+func logStatsOnSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+
+	for range c {
+		for _, challengeType := range []string{challengeTypeImage, challengeTypeJS, challengeTypeSlider} {
+			logMessage(
+				slog.LevelInfo, messageSolveTimes,
+				"type", challengeType,
+				"solve_time", solveTimes.With(challengeType).String(),
+			)
+		}
+
+		for _, record := range bans.List() {
+			logMessage(
+				slog.LevelInfo, messageActiveBan,
+				"ban", record.Key,
+				"ban_reason", record.Reason,
+				"count", record.Count,
+				"since", record.Since.Format(time.RFC3339),
+				"until", record.Until.Format(time.RFC3339),
+			)
+		}
+	}
+}
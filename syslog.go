@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// datagramConn sends datagrams to unix socket, connection is reopened after write error.
+type datagramConn struct {
+	mu   sync.Mutex
+	path string
+	conn net.Conn
+}
+
+// syslogWriter writes RFC 5424 messages to local syslog datagram socket.
+type syslogWriter struct {
+	conn     *datagramConn
+	hostname string
+	appName  string
+}
+
+// Send writes datagram before ctx deadline, connection is reopened once when write fails.
+func (d *datagramConn) Send(ctx context.Context, b []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// zero deadline means no deadline
+	deadline, _ := ctx.Deadline()
+
+	for attempt := 0; attempt < 2; attempt++ {
+		if d.conn == nil {
+			var dialer net.Dialer
+
+			conn, err := dialer.DialContext(ctx, "unixgram", d.path)
+			if err != nil {
+				return fmt.Errorf("socket error: %w", err)
+			}
+
+			d.conn = conn
+		}
+
+		if err := d.conn.SetWriteDeadline(deadline); err != nil {
+			return fmt.Errorf("socket error: %w", err)
+		}
+
+		_, err := d.conn.Write(b)
+		if err == nil {
+			return nil
+		}
+
+		// reconnect once, receiving daemon may have been restarted
+		d.conn.Close()
+		d.conn = nil
+
+		// stalled receiver is not retried
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return fmt.Errorf("socket error: %w", err)
+		}
+	}
+
+	return fmt.Errorf("socket error: write to %s failed", d.path)
+}
+
+// Close closes socket connection.
+func (d *datagramConn) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.conn == nil {
+		return nil
+	}
+
+	err := d.conn.Close()
+	d.conn = nil
+
+	return err
+}
+
+// newSyslogWriter creates syslog writer for socket path, empty path uses /dev/log.
+func newSyslogWriter(path string) *syslogWriter {
+	if path == "" {
+		path = defaultSyslogPath
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+
+	return &syslogWriter{
+		conn:     &datagramConn{path: path},
+		hostname: hostname,
+		appName:  filepath.Base(os.Args[0]),
+	}
+}
+
+// formatSyslog formats RFC 5424 message.
+func formatSyslog(facility, severity int, timestamp time.Time, hostname, appName, msgID string, msg []byte) []byte {
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %d %s - ",
+		facility*8+severity,
+		timestamp.Format(syslogTimeLayout),
+		getSyslogField(hostname),
+		getSyslogField(appName),
+		os.Getpid(),
+		getSyslogField(msgID),
+	)
+
+	b.Write(bytes.TrimRight(msg, "\n"))
+
+	return b.Bytes()
+}
+
+// getSyslogField returns printable header field without spaces, empty field is "-".
+func getSyslogField(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return -1
+		}
+
+		return r
+	}, s)
+
+	if s == "" {
+		return "-"
+	}
+
+	return s
+}
+
+// getSyslogFacility returns facility code by name, like "daemon" or "local0".
+func getSyslogFacility(name string) (int, error) {
+	facilities := map[string]int{
+		"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+		"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+		"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+	}
+
+	facility, ok := facilities[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("syslog error: unknown facility '%s'", name)
+	}
+
+	return facility, nil
+}
+
+// Path returns syslog socket path.
+func (s *syslogWriter) Path() string {
+	return s.conn.path
+}
+
+// Write sends message with specified facility, severity, tag and message ID before ctx deadline,
+// empty tag uses program name.
+func (s *syslogWriter) Write(ctx context.Context, facility, severity int, tag, msgID string, msg []byte) error {
+	if tag == "" {
+		tag = s.appName
+	}
+
+	if err := s.conn.Send(ctx, formatSyslog(facility, severity, time.Now(), s.hostname, tag, msgID, msg)); err != nil {
+		return fmt.Errorf("syslog error: %w", err)
+	}
+
+	return nil
+}
@@ -1,5 +1,28 @@
 package main
 
+import "html/template"
+
+// templateData defines data needed for captcha template render.
+type templateData struct {
+	Base64       string
+	TextHash     string
+	ChallengeKey string
+	ResponseKey  string
+	ImageID      string
+	Length       int
+	Honeypots    []honeypot
+	AltChallenge string
+
+	JSScript template.JS
+	JSDelay  int
+
+	TrajectoryKey    string
+	SliderBackground string
+	SliderPiece      string
+	SliderY          int
+	SliderMax        int
+}
+
 const captchaHTML = `
 <!DOCTYPE html>
 <html lang="en">
@@ -48,6 +71,13 @@ const captchaHTML = `
         background: #0b7dda;
       }
 
+      form.captcha .hp {
+        position: absolute;
+        left: -10000px;
+        height: 0;
+        overflow: hidden;
+      }
+
       form.captcha::after {
         content: "";
         clear: both;
@@ -64,9 +94,12 @@ const captchaHTML = `
 
       <img src="data:image/png;base64, {{ .Base64 }}" alt="{{ .TextHash }}" id="{{ .ImageID }}" />
 
-      <form id="captcha_form" class="captcha" method="POST" action="/">
+      <form id="captcha_form" class="captcha" method="POST">
         <input type="hidden" name="{{ .ChallengeKey }}" value="{{ .TextHash }}">
-        <input type="text" name="{{ .ResponseKey }}" minlength="6" maxlength="6" pattern="[A-Za-z0-9]{6}" value="" autocomplete="off" autofocus>
+        {{- range .Honeypots }}
+        <div class="hp" aria-hidden="true"><label>{{ .Label }} <input type="text" name="{{ .Name }}" value="" tabindex="-1" autocomplete="new-password"></label></div>
+        {{- end }}
+        <input type="text" name="{{ .ResponseKey }}" minlength="{{ .Length }}" maxlength="{{ .Length }}" pattern="[A-Za-z0-9]{ {{- .Length -}} }" value="" autocomplete="off" autofocus>
 
         <button type="submit">VERIFY</button>
       </form>
@@ -76,19 +109,21 @@ const captchaHTML = `
           event.preventDefault();
 
           var xhr = new XMLHttpRequest();
-          var data = new URLSearchParams();
+          var data = new URLSearchParams(new FormData(document.getElementById('captcha_form')));
 
-          data.append('{{ .ChallengeKey }}', '{{ .TextHash }}');
-          data.append('{{ .ResponseKey }}', document.getElementById('captcha_form').elements['{{ .ResponseKey }}'].value);
-
-          xhr.open('POST', '/', true);
+          xhr.open('POST', window.location.href, true);
           xhr.setRequestHeader('Content-Type', 'application/x-www-form-urlencoded; charset=UTF-8');
           xhr.send(data);
 
           xhr.onreadystatechange = function() {
             if (this.readyState != 4) return;
-            window.location.assign(window.location.href);
-            document.location.reload(true);
+
+            // redirect is followed by XHR, navigate to its final URL
+            if (this.responseURL && this.responseURL != window.location.href) {
+              window.location.assign(this.responseURL);
+            } else {
+              document.location.reload(true);
+            }
           }
         });
       </script>
@@ -105,3 +140,509 @@ const captchaHTML = `
 const captchaLight = `
 <img src="data:image/png;base64, {{ .Base64 }}" alt="{{ .TextHash }}" id="{{ .ImageID }}" />
 `
+
+const captchaJS = `
+<!DOCTYPE html>
+<html lang="en">
+  <head>
+    <meta charset="UTF-8" name="viewport" content="width=device-width, initial-scale=1">
+    <meta http-equiv="Cache-Control" content="no-cache, no-store, must-revalidate"/>
+    <title>Checking your browser</title>
+
+    <style>
+      * {
+        box-sizing: border-box;
+      }
+
+      .container {
+        margin: auto;
+        max-width: 320px;
+      }
+
+      .container h2 {
+        text-align: center;
+      }
+
+      form.captcha input[type="text"] {
+        text-align: center;
+        padding: 10px;
+        font-size: 17px;
+        border: 1px solid grey;
+        float: left;
+        width: 74%;
+        background: #f1f1f1;
+      }
+
+      form.captcha button {
+        float: left;
+        width: 26%;
+        padding: 10px;
+        background: #2196F3;
+        color: white;
+        font-size: 17px;
+        border: 1px solid grey;
+        border-left: none;
+        cursor: pointer;
+      }
+
+      form.captcha button:hover {
+        background: #0b7dda;
+      }
+
+      form.captcha .hp {
+        position: absolute;
+        left: -10000px;
+        height: 0;
+        overflow: hidden;
+      }
+
+      form.captcha::after {
+        content: "";
+        clear: both;
+        display: table;
+      }
+
+    </style>
+  </head>
+
+  <body>
+    <div class="container">
+      <h2>Checking your browser</h2>
+
+      <noscript>
+        <p>Please verify that you are not a robot.</p>
+
+        <img src="data:image/png;base64, {{ .Base64 }}" alt="{{ .TextHash }}" id="{{ .ImageID }}" />
+
+        <form class="captcha" method="POST">
+          <input type="hidden" name="{{ .ChallengeKey }}" value="{{ .TextHash }}">
+          {{- range .Honeypots }}
+          <div class="hp" aria-hidden="true"><label>{{ .Label }} <input type="text" name="{{ .Name }}" value="" tabindex="-1" autocomplete="new-password"></label></div>
+          {{- end }}
+          <input type="text" name="{{ .ResponseKey }}" minlength="{{ .Length }}" maxlength="{{ .Length }}" pattern="[A-Za-z0-9]{ {{- .Length -}} }" value="" autocomplete="off" autofocus>
+
+          <button type="submit">VERIFY</button>
+        </form>
+      </noscript>
+
+      <p id="captcha_status" style="display: none;">This process is automatic, you will be redirected shortly.</p>
+
+      <script async="false">
+        document.getElementById('captcha_status').style.display = 'block';
+
+        setTimeout(function() {
+          var xhr = new XMLHttpRequest();
+          var data = new URLSearchParams();
+          var result = '';
+
+          try {
+            result = String({{ .JSScript }}());
+          } catch (e) {}
+
+          data.append('{{ .ChallengeKey }}', '{{ .AltChallenge }}');
+          data.append('{{ .ResponseKey }}', result);
+
+          xhr.open('POST', window.location.href, true);
+          xhr.setRequestHeader('Content-Type', 'application/x-www-form-urlencoded; charset=UTF-8');
+          xhr.send(data);
+
+          xhr.onreadystatechange = function() {
+            if (this.readyState != 4) return;
+
+            // redirect is followed by XHR, navigate to its final URL
+            if (this.responseURL && this.responseURL != window.location.href) {
+              window.location.assign(this.responseURL);
+            } else {
+              document.location.reload(true);
+            }
+          }
+        }, {{ .JSDelay }});
+      </script>
+
+    </div>
+  </body>
+</html>
+`
+
+const captchaSlider = `
+<!DOCTYPE html>
+<html lang="en">
+  <head>
+    <meta charset="UTF-8" name="viewport" content="width=device-width, initial-scale=1">
+    <meta http-equiv="Cache-Control" content="no-cache, no-store, must-revalidate"/>
+    <title>CAPTCHA</title>
+
+    <style>
+      * {
+        box-sizing: border-box;
+      }
+
+      .container {
+        margin: auto;
+        max-width: 320px;
+      }
+
+      .container h2 {
+        text-align: center;
+      }
+
+      .puzzle {
+        position: relative;
+      }
+
+      .puzzle img {
+        display: block;
+      }
+
+      .puzzle img.piece {
+        position: absolute;
+        left: 0;
+        box-shadow: 0 0 4px black;
+      }
+
+      input[type="range"] {
+        width: 100%;
+        margin: 10px 0;
+      }
+
+      form.captcha input[type="text"] {
+        text-align: center;
+        padding: 10px;
+        font-size: 17px;
+        border: 1px solid grey;
+        float: left;
+        width: 74%;
+        background: #f1f1f1;
+      }
+
+      form.captcha button {
+        float: left;
+        width: 26%;
+        padding: 10px;
+        background: #2196F3;
+        color: white;
+        font-size: 17px;
+        border: 1px solid grey;
+        border-left: none;
+        cursor: pointer;
+      }
+
+      form.captcha button:hover {
+        background: #0b7dda;
+      }
+
+      form.captcha .hp {
+        position: absolute;
+        left: -10000px;
+        height: 0;
+        overflow: hidden;
+      }
+
+      form.captcha::after {
+        content: "";
+        clear: both;
+        display: table;
+      }
+
+    </style>
+  </head>
+
+  <body>
+    <div class="container">
+      <h2>CAPTCHA</h2>
+
+      <noscript>
+        <p>Please verify that you are not a robot.</p>
+
+        <img src="data:image/png;base64, {{ .Base64 }}" alt="{{ .TextHash }}" id="{{ .ImageID }}" />
+
+        <form class="captcha" method="POST">
+          <input type="hidden" name="{{ .ChallengeKey }}" value="{{ .TextHash }}">
+          {{- range .Honeypots }}
+          <div class="hp" aria-hidden="true"><label>{{ .Label }} <input type="text" name="{{ .Name }}" value="" tabindex="-1" autocomplete="new-password"></label></div>
+          {{- end }}
+          <input type="text" name="{{ .ResponseKey }}" minlength="{{ .Length }}" maxlength="{{ .Length }}" pattern="[A-Za-z0-9]{ {{- .Length -}} }" value="" autocomplete="off" autofocus>
+
+          <button type="submit">VERIFY</button>
+        </form>
+      </noscript>
+
+      <div id="captcha_slider" style="display: none;">
+        <p>Please drag the slider to fit the puzzle piece.</p>
+
+        <div class="puzzle">
+          <img src="data:image/jpeg;base64, {{ .SliderBackground }}" alt="" />
+          <img class="piece" id="captcha_piece" src="data:image/png;base64, {{ .SliderPiece }}" alt="" style="top: {{ .SliderY }}px;" />
+        </div>
+
+        <input type="range" id="captcha_range" min="0" max="{{ .SliderMax }}" value="0">
+      </div>
+
+      <script async="false">
+        var slider = document.getElementById('captcha_range');
+        var piece = document.getElementById('captcha_piece');
+        var trajectory = [];
+        var start = null;
+
+        document.getElementById('captcha_slider').style.display = 'block';
+
+        slider.addEventListener('input', function() {
+          var now = Math.round(performance.now());
+
+          if (start === null) start = now;
+
+          trajectory.push((now - start) + ':' + slider.value);
+          piece.style.left = slider.value + 'px';
+        });
+
+        slider.addEventListener('change', function() {
+          var xhr = new XMLHttpRequest();
+          var data = new URLSearchParams();
+
+          slider.disabled = true;
+          trajectory.push((Math.round(performance.now()) - (start || 0)) + ':' + slider.value);
+
+          data.append('{{ .ChallengeKey }}', '{{ .AltChallenge }}');
+          data.append('{{ .ResponseKey }}', slider.value);
+          data.append('{{ .TrajectoryKey }}', trajectory.join(','));
+
+          xhr.open('POST', window.location.href, true);
+          xhr.setRequestHeader('Content-Type', 'application/x-www-form-urlencoded; charset=UTF-8');
+          xhr.send(data);
+
+          xhr.onreadystatechange = function() {
+            if (this.readyState != 4) return;
+
+            // redirect is followed by XHR, navigate to its final URL
+            if (this.responseURL && this.responseURL != window.location.href) {
+              window.location.assign(this.responseURL);
+            } else {
+              document.location.reload(true);
+            }
+          }
+        });
+      </script>
+
+    </div>
+  </body>
+</html>
+`
+
+/*
+  Embeddable widget, renders captcha into every element with "nginx-captcha" class
+  and stores single-use token into hidden input of enclosing form.
+
+  <div class="nginx-captcha" data-name="captcha-token" data-callback="onCaptcha"></div>
+  <script src="/captcha-widget/widget.js" async></script>
+*/
+const captchaWidget = `
+(function() {
+  var prefix = '/captcha-widget/';
+
+  function render(el) {
+    var token = document.createElement('input');
+    var img = document.createElement('img');
+    var text = document.createElement('input');
+    var button = document.createElement('button');
+    var challenge = null;
+
+    token.type = 'hidden';
+    token.name = el.getAttribute('data-name') || 'captcha-token';
+
+    text.type = 'text';
+    text.autocomplete = 'off';
+
+    button.type = 'button';
+    button.textContent = 'VERIFY';
+
+    function load() {
+      token.value = '';
+      text.value = '';
+
+      fetch(prefix + 'challenge', {
+        headers: {'Accept': 'application/json'},
+        credentials: 'same-origin'
+      }).then(function(response) {
+        return response.json();
+      }).then(function(data) {
+        challenge = data;
+        img.src = data.image;
+        text.minLength = data.constraints.length;
+        text.maxLength = data.constraints.length;
+      });
+    }
+
+    button.addEventListener('click', function() {
+      if (challenge === null) return;
+
+      fetch(prefix + 'verify', {
+        method: 'POST',
+        headers: {'Accept': 'application/json', 'Content-Type': 'application/json'},
+        credentials: 'same-origin',
+        body: JSON.stringify({challenge: challenge.challenge, response: text.value})
+      }).then(function(response) {
+        return response.json();
+      }).then(function(data) {
+        if (!data.success) {
+          load();
+
+          return;
+        }
+
+        token.value = data.token;
+        el.textContent = 'Verified';
+        el.appendChild(token);
+
+        var callback = window[el.getAttribute('data-callback')];
+        if (typeof callback === 'function') callback(data.token);
+      });
+    });
+
+    el.appendChild(img);
+    el.appendChild(text);
+    el.appendChild(button);
+    el.appendChild(token);
+
+    load();
+  }
+
+  function init() {
+    var elements = document.querySelectorAll('.nginx-captcha');
+
+    for (var i = 0; i < elements.length; i++) {
+      render(elements[i]);
+    }
+  }
+
+  if (document.readyState === 'loading') {
+    document.addEventListener('DOMContentLoaded', init);
+  } else {
+    init();
+  }
+})();
+`
+
+// SSO consume page, meta refresh makes navigation same-site so that strict authentication cookie is sent.
+const captchaSSO = `
+<!DOCTYPE html>
+<html lang="en">
+  <head>
+    <meta charset="UTF-8" name="viewport" content="width=device-width, initial-scale=1">
+    <meta http-equiv="Cache-Control" content="no-cache, no-store, must-revalidate"/>
+    <meta http-equiv="refresh" content="0; url={{ .URI }}">
+    <title>Redirecting</title>
+  </head>
+
+  <body>
+    <p><a href="{{ .URI }}">Continue</a></p>
+  </body>
+</html>
+`
+
+const dashboardHTML = `
+<!DOCTYPE html>
+<html lang="en">
+  <head>
+    <meta charset="UTF-8" name="viewport" content="width=device-width, initial-scale=1">
+    <title>Captcha Dashboard</title>
+    <style>
+      body { font-family: sans-serif; margin: 2em; color: #222; }
+      h1 { font-size: 1.4em; }
+      h2 { font-size: 1.1em; margin-top: 1.5em; }
+      table { border-collapse: collapse; min-width: 30em; }
+      th, td { border-bottom: 1px solid #ddd; padding: 0.3em 0.8em; text-align: left; }
+      td.n { text-align: right; font-variant-numeric: tabular-nums; }
+      .summary span { display: inline-block; margin-right: 2em; }
+      .error { color: #b00; }
+      #state { color: #888; font-size: 0.9em; }
+    </style>
+  </head>
+  <body>
+    <h1>Captcha Dashboard</h1>
+    <p id="state">connecting</p>
+
+    <p class="summary">
+      <span>Sessions: <b id="sessions">-</b></span>
+      <span>Pending challenges: <b id="challenges">-</b></span>
+      <span>Active bans: <b id="bans">-</b></span>
+    </p>
+
+    <h2>Captcha DB</h2>
+    <p>
+      <span id="db"></span>
+      <span id="db-error" class="error"></span>
+    </p>
+
+    <h2>Challenges per domain</h2>
+    <table>
+      <thead><tr><th>Domain</th><th>Served</th><th>Solved</th><th>Failed</th></tr></thead>
+      <tbody id="domains"></tbody>
+    </table>
+
+    <h2>Top offending addresses</h2>
+    <table>
+      <thead><tr><th>Address</th><th>Bot events</th><th>Domain</th><th>Last reason</th><th>Last seen</th></tr></thead>
+      <tbody id="offenders"></tbody>
+    </table>
+
+    <script>
+      function text(id, value) {
+        document.getElementById(id).textContent = value;
+      }
+
+      function rows(id, items, cells) {
+        var body = document.getElementById(id);
+        body.replaceChildren();
+
+        items.forEach(function (item) {
+          var tr = document.createElement("tr");
+
+          cells(item).forEach(function (cell) {
+            var td = document.createElement("td");
+            td.textContent = cell;
+            if (typeof cell === "number") {
+              td.className = "n";
+            }
+            tr.appendChild(td);
+          });
+
+          body.appendChild(tr);
+        });
+      }
+
+      function render(s) {
+        var pending = 0;
+        for (var t in s.challenges || {}) {
+          pending += s.challenges[t];
+        }
+
+        text("sessions", s.sessions);
+        text("challenges", pending);
+        text("bans", s.bans);
+        text("db", s.db.path + ": " + s.db.size + " CAPTCHAs, loaded " + new Date(s.db.loaded).toLocaleString());
+        text("db-error", s.db.error ? "last reload failed: " + s.db.error : "");
+
+        rows("domains", s.domains, function (d) {
+          return [d.domain, d.served, d.solved, d.failed];
+        });
+
+        rows("offenders", s.offenders, function (o) {
+          return [o.address, o.count, o.domain, o.reason, new Date(o.last).toLocaleTimeString()];
+        });
+
+        text("state", "updated " + new Date(s.time).toLocaleTimeString());
+      }
+
+      var events = new EventSource("dashboard/events");
+
+      events.addEventListener("stats", function (e) {
+        render(JSON.parse(e.data));
+      });
+
+      events.onerror = function () {
+        text("state", "disconnected, reconnecting");
+      };
+    </script>
+  </body>
+</html>
+`
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	mathrand "math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// span defines server span of traced handler.
+type span struct {
+	mu sync.Mutex
+
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+
+	name  string
+	start time.Time
+	end   time.Time
+
+	domain       string
+	outcome      string
+	statusCode   int
+	storeLatency time.Duration
+	storeOps     int
+}
+
+// spanExporter batches finished spans and exports them with OTLP/HTTP JSON encoding.
+type spanExporter struct {
+	mu      sync.RWMutex
+	closed  bool
+	url     string
+	headers map[string]string
+	service string
+	client  *http.Client
+	queue   chan *span
+	done    chan struct{}
+}
+
+// statusRecorder records response status code of traced handler.
+type statusRecorder struct {
+	http.ResponseWriter
+
+	status int
+}
+
+// otlpValue defines OTLP JSON attribute value.
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+// otlpKeyValue defines OTLP JSON attribute.
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+// otlpStatus defines OTLP JSON span status.
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// otlpSpan defines OTLP JSON span, IDs are hex encoded.
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes"`
+	Status            otlpStatus     `json:"status"`
+}
+
+// otlpScopeSpans defines OTLP JSON instrumentation scope spans.
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+// otlpResourceSpans defines OTLP JSON resource spans.
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+// otlpTraces defines OTLP JSON export request.
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+// spanContextKey defines request context key of active span.
+type spanContextKey struct{}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+
+	return r.ResponseWriter.Write(b)
+}
+
+// Unwrap returns wrapped response writer for http.ResponseController.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// parseTraceparent parses W3C trace context header, "00-TRACEID-PARENTID-FLAGS".
+func parseTraceparent(s string) (traceID [16]byte, parentID [8]byte, sampled bool, ok bool) {
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return traceID, parentID, false, false
+	}
+
+	// version 00 has exactly four fields
+	if parts[0] == "00" && len(parts) != 4 {
+		return traceID, parentID, false, false
+	}
+
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return traceID, parentID, false, false
+	}
+
+	if _, err = hex.Decode(traceID[:], []byte(parts[1])); err != nil || traceID == [16]byte{} {
+		return traceID, parentID, false, false
+	}
+
+	if _, err = hex.Decode(parentID[:], []byte(parts[2])); err != nil || parentID == [8]byte{} {
+		return traceID, parentID, false, false
+	}
+
+	return traceID, parentID, flags[0]&1 == 1, true
+}
+
+// startSpan starts span that continues incoming trace context, nil span means request is not sampled,
+// incoming sampled flag is client controlled so it only skips sampling and never bypasses sample ratio.
+func startSpan(r *http.Request, name string) *span {
+	s := &span{
+		name:   name,
+		start:  time.Now(),
+		domain: getRequestDomain(r.Header),
+	}
+
+	traceID, parentID, sampled, ok := parseTraceparent(r.Header.Get("traceparent"))
+
+	if (ok && !sampled) || mathrand.Float64() >= cmdTraceSampleRatio {
+		return nil
+	}
+
+	if ok {
+		s.traceID, s.parentID = traceID, parentID
+	} else if _, err := rand.Read(s.traceID[:]); err != nil {
+		// root span
+		return nil
+	}
+
+	if _, err := rand.Read(s.spanID[:]); err != nil {
+		return nil
+	}
+
+	return s
+}
+
+// getSpan returns active span of request, nil when request is not traced.
+func getSpan(r *http.Request) *span {
+	s, _ := r.Context().Value(spanContextKey{}).(*span)
+
+	return s
+}
+
+// setSpanOutcome records outcome reason of traced request.
+func setSpanOutcome(r *http.Request, reason string) {
+	if s := getSpan(r); s != nil {
+		s.mu.Lock()
+		s.outcome = reason
+		s.mu.Unlock()
+	}
+}
+
+// observeStore adds duration of db operation started at start to store latency of traced request.
+func observeStore(r *http.Request, start time.Time) {
+	if s := getSpan(r); s != nil {
+		s.mu.Lock()
+		s.storeLatency += time.Since(start)
+		s.storeOps++
+		s.mu.Unlock()
+	}
+}
+
+// traceHandler wraps handler with server span when tracing is enabled.
+func traceHandler(name string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if tracer == nil {
+			h(w, r)
+
+			return
+		}
+
+		s := startSpan(r, name)
+		if s == nil {
+			h(w, r)
+
+			return
+		}
+
+		rec := &statusRecorder{ResponseWriter: w}
+
+		h(rec, r.WithContext(context.WithValue(r.Context(), spanContextKey{}, s)))
+
+		s.mu.Lock()
+		s.end = time.Now()
+		s.statusCode = rec.status
+		s.mu.Unlock()
+
+		tracer.Export(s)
+	}
+}
+
+// newOTLPString returns OTLP string attribute.
+func newOTLPString(key, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpValue{StringValue: &value}}
+}
+
+// newOTLPInt returns OTLP integer attribute.
+func newOTLPInt(key string, value int) otlpKeyValue {
+	s := strconv.Itoa(value)
+
+	return otlpKeyValue{Key: key, Value: otlpValue{IntValue: &s}}
+}
+
+// newOTLPDouble returns OTLP floating point attribute.
+func newOTLPDouble(key string, value float64) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpValue{DoubleValue: &value}}
+}
+
+// toOTLP converts finished span to OTLP JSON span.
+func (s *span) toOTLP() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              otlpSpanKindServer,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Attributes: []otlpKeyValue{
+			newOTLPString("captcha.domain", s.domain),
+			newOTLPString("captcha.outcome", s.outcome),
+			newOTLPDouble("captcha.store.latency_ms", float64(s.storeLatency.Microseconds())/1000),
+			newOTLPInt("captcha.store.operations", s.storeOps),
+			newOTLPInt("http.response.status_code", s.statusCode),
+		},
+	}
+
+	if s.parentID != [8]byte{} {
+		out.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+
+	// server errors are span errors, rejected clients are expected outcomes
+	if s.statusCode >= http.StatusInternalServerError {
+		out.Status = otlpStatus{Code: otlpStatusError, Message: s.outcome}
+	}
+
+	return out
+}
+
+// readTraceHeaders reads export request headers file with "NAME: VALUE" line per header,
+// empty path means no headers.
+func readTraceHeaders(path string) (map[string]string, error) {
+	headers := make(map[string]string)
+
+	if path == "" {
+		return headers, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("trace exporter error: %w", err)
+	}
+
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			// line is not printed, it may contain credentials
+			return nil, fmt.Errorf("trace exporter error: invalid header line in '%s'", path)
+		}
+
+		headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+
+	return headers, nil
+}
+
+// newSpanExporter creates exporter for OTLP/HTTP endpoint, "/v1/traces" path is added to endpoint without path.
+func newSpanExporter(endpoint, headersPath, service string) (*spanExporter, error) {
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		return nil, fmt.Errorf("trace exporter error: endpoint must be HTTP URL")
+	}
+
+	h, err := readTraceHeaders(headersPath)
+	if err != nil {
+		return nil, err
+	}
+
+	u := strings.TrimRight(endpoint, "/")
+	if !strings.HasSuffix(u, "/v1/traces") {
+		u += "/v1/traces"
+	}
+
+	return &spanExporter{
+		url:     u,
+		headers: h,
+		service: service,
+		client:  &http.Client{Timeout: traceExportTimeout},
+		queue:   make(chan *span, traceQueueSize),
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// Export queues finished span, span is dropped when queue is full.
+func (e *spanExporter) Export(s *span) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.closed {
+		return
+	}
+
+	select {
+	case e.queue <- s:
+	default:
+		logMessage(slog.LevelWarn, messageSpanDropped, "span", s.name)
+	}
+}
+
+// Run exports queued spans in batches until queue is closed.
+func (e *spanExporter) Run() {
+	defer close(e.done)
+
+	ticker := time.NewTicker(traceExportInterval)
+	defer ticker.Stop()
+
+	batch := make([]*span, 0, traceBatchSize)
+
+	for {
+		select {
+		case s, ok := <-e.queue:
+			if !ok {
+				e.send(batch)
+
+				return
+			}
+
+			batch = append(batch, s)
+
+			if len(batch) >= traceBatchSize {
+				e.send(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			e.send(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+// send posts batch of spans to collector.
+func (e *spanExporter) send(batch []*span) {
+	if len(batch) == 0 {
+		return
+	}
+
+	scope := otlpScopeSpans{Spans: make([]otlpSpan, 0, len(batch))}
+	scope.Scope.Name = traceScopeName
+
+	for _, s := range batch {
+		scope.Spans = append(scope.Spans, s.toOTLP())
+	}
+
+	resource := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{scope}}
+	resource.Resource.Attributes = []otlpKeyValue{newOTLPString("service.name", e.service)}
+
+	b, err := json.Marshal(otlpTraces{ResourceSpans: []otlpResourceSpans{resource}})
+	if err != nil {
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(b))
+	if err != nil {
+		return
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	for name, value := range e.headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		logMessage(slog.LevelWarn, messageSpanExportFailed, "error", err.Error(), "spans", len(batch))
+
+		return
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		logMessage(slog.LevelWarn, messageSpanExportFailed, "error", resp.Status, "spans", len(batch))
+	}
+}
+
+// Close exports queued spans and waits until export is finished or ctx is done.
+func (e *spanExporter) Close(ctx context.Context) error {
+	e.mu.Lock()
+
+	if !e.closed {
+		e.closed = true
+
+		close(e.queue)
+	}
+
+	e.mu.Unlock()
+
+	select {
+	case <-e.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("trace exporter error: %w", ctx.Err())
+	}
+}
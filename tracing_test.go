@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// otlpCollector records export requests of span exporter.
+type otlpCollector struct {
+	mu       sync.Mutex
+	requests []otlpTraces
+	headers  []http.Header
+}
+
+func (c *otlpCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var traces otlpTraces
+
+	if r.Method != http.MethodPost || r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+		w.WriteHeader(http.StatusBadRequest)
+
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&traces); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+
+		return
+	}
+
+	c.mu.Lock()
+	c.requests = append(c.requests, traces)
+	c.headers = append(c.headers, r.Header.Clone())
+	c.mu.Unlock()
+}
+
+// spans returns exported spans by span name.
+func (c *otlpCollector) spans(t *testing.T) map[string]otlpSpan {
+	t.Helper()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	out := make(map[string]otlpSpan)
+
+	for _, req := range c.requests {
+		for _, resource := range req.ResourceSpans {
+			if len(resource.Resource.Attributes) != 1 || *resource.Resource.Attributes[0].Value.StringValue != "test-service" {
+				t.Errorf("unexpected resource attributes %+v", resource.Resource.Attributes)
+			}
+
+			for _, scope := range resource.ScopeSpans {
+				if scope.Scope.Name != traceScopeName {
+					t.Errorf("scope name %q, want %q", scope.Scope.Name, traceScopeName)
+				}
+
+				for _, s := range scope.Spans {
+					out[s.Name] = s
+				}
+			}
+		}
+	}
+
+	return out
+}
+
+// getOTLPAttribute returns attribute value of span as string.
+func getOTLPAttribute(s otlpSpan, key string) (string, bool) {
+	for _, a := range s.Attributes {
+		if a.Key != key {
+			continue
+		}
+
+		switch {
+		case a.Value.StringValue != nil:
+			return *a.Value.StringValue, true
+		case a.Value.IntValue != nil:
+			return *a.Value.IntValue, true
+		case a.Value.DoubleValue != nil:
+			return "double", true
+		}
+	}
+
+	return "", false
+}
+
+// startTestTracer sets global tracer that exports to collector stand-in.
+func startTestTracer(t *testing.T, ratio float64) (*spanExporter, *otlpCollector) {
+	t.Helper()
+
+	collector := new(otlpCollector)
+
+	srv := httptest.NewServer(collector)
+	t.Cleanup(srv.Close)
+
+	headersPath := filepath.Join(t.TempDir(), "headers")
+	if err := os.WriteFile(headersPath, []byte("Authorization: Bearer collector-token\n\nX-Scope-OrgID: tenant\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	exporter, err := newSpanExporter(srv.URL, headersPath, "test-service")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go exporter.Run()
+
+	prevTracer, prevRatio := tracer, cmdTraceSampleRatio
+	tracer, cmdTraceSampleRatio = exporter, ratio
+
+	t.Cleanup(func() {
+		tracer, cmdTraceSampleRatio = prevTracer, prevRatio
+	})
+
+	return exporter, collector
+}
+
+// serveTraced calls traced handler with request headers.
+func serveTraced(name, traceparent string, h http.HandlerFunc) {
+	r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+	r.Header.Set("X-Forwarded-Host", "Example.COM")
+
+	if traceparent != "" {
+		r.Header.Set("traceparent", traceparent)
+	}
+
+	traceHandler(name, h)(httptest.NewRecorder(), r)
+}
+
+func TestTraceExport(t *testing.T) {
+	exporter, collector := startTestTracer(t, 1)
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		observeStore(r, time.Now().Add(-time.Millisecond))
+		setSpanOutcome(r, messageInvalidResponse)
+
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+
+	serveTraced("child", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", handler)
+	serveTraced("root", "", handler)
+	serveTraced("unsampled", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00", handler)
+	serveTraced("failed", "", func(w http.ResponseWriter, r *http.Request) {
+		setSpanOutcome(r, messageFailedEntropy)
+
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := exporter.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := collector.spans(t)
+
+	if len(spans) != 3 {
+		t.Fatalf("exported %d spans, want 3", len(spans))
+	}
+
+	if _, ok := spans["unsampled"]; ok {
+		t.Error("span with unsampled parent exported")
+	}
+
+	child := spans["child"]
+	if child.TraceID != "0af7651916cd43dd8448eb211c80319c" || child.ParentSpanID != "b7ad6b7169203331" {
+		t.Errorf("child span trace %q parent %q does not continue incoming trace", child.TraceID, child.ParentSpanID)
+	}
+
+	root := spans["root"]
+	if len(root.TraceID) != 32 || root.TraceID == child.TraceID || root.ParentSpanID != "" {
+		t.Errorf("root span trace %q parent %q is not new trace", root.TraceID, root.ParentSpanID)
+	}
+
+	for name, s := range spans {
+		if len(s.SpanID) != 16 || s.Kind != otlpSpanKindServer || s.StartTimeUnixNano > s.EndTimeUnixNano {
+			t.Errorf("%s: invalid span %+v", name, s)
+		}
+	}
+
+	attributes := map[string]string{
+		"captcha.domain":            "example.com",
+		"captcha.outcome":           messageInvalidResponse,
+		"captcha.store.latency_ms":  "double",
+		"captcha.store.operations":  "1",
+		"http.response.status_code": "401",
+	}
+
+	for key, want := range attributes {
+		if got, _ := getOTLPAttribute(child, key); got != want {
+			t.Errorf("attribute %s = %q, want %q", key, got, want)
+		}
+	}
+
+	if root.Status.Code != 0 {
+		t.Errorf("rejected request has span status %d", root.Status.Code)
+	}
+
+	if failed := spans["failed"]; failed.Status.Code != otlpStatusError || failed.Status.Message != messageFailedEntropy {
+		t.Errorf("server error has span status %+v", failed.Status)
+	}
+
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+
+	for _, h := range collector.headers {
+		if h.Get("Authorization") != "Bearer collector-token" || h.Get("X-Scope-OrgID") != "tenant" {
+			t.Errorf("export request headers %v do not contain configured headers", h)
+		}
+	}
+}
+
+func TestTraceSampleRatio(t *testing.T) {
+	exporter, collector := startTestTracer(t, 0)
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if getSpan(r) != nil {
+			t.Error("request traced with zero sample ratio")
+		}
+	}
+
+	// sampled flag of client trace context does not bypass sample ratio
+	serveTraced("child", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", handler)
+	serveTraced("root", "", handler)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := exporter.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if spans := collector.spans(t); len(spans) != 0 {
+		t.Errorf("exported %d spans, want 0", len(spans))
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		header  string
+		sampled bool
+		ok      bool
+	}{
+		{"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", true, true},
+		{"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00", false, true},
+		{"00-00000000000000000000000000000000-b7ad6b7169203331-01", false, false},
+		{"00-0af7651916cd43dd8448eb211c80319c-0000000000000000-01", false, false},
+		{"ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", false, false},
+		{"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331", false, false},
+		{"00-zzf7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", false, false},
+		{"", false, false},
+	}
+
+	for _, tt := range tests {
+		_, _, sampled, ok := parseTraceparent(tt.header)
+		if sampled != tt.sampled || ok != tt.ok {
+			t.Errorf("parseTraceparent(%q) = %v, %v, want %v, %v", tt.header, sampled, ok, tt.sampled, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// siteverifyResponse defines JSON site verification response.
+type siteverifyResponse struct {
+	Success     bool       `json:"success"`
+	Hostname    string     `json:"hostname,omitempty"`
+	ChallengeTS *time.Time `json:"challenge_ts,omitempty"`
+	ErrorCodes  []string   `json:"error-codes,omitempty"`
+}
+
+// readSiteSecrets reads site secrets file with "DOMAIN SECRET" lines.
+func readSiteSecrets(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("site secrets error: %w", err)
+	}
+
+	defer f.Close()
+
+	secrets := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		// skip empty lines and comments
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("site secrets error: invalid line '%s'", fields[0])
+		}
+
+		secrets[strings.ToLower(fields[0])] = fields[1]
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("site secrets error: %w", err)
+	}
+
+	return secrets, nil
+}
+
+// loadSiteSecrets reads site secrets file and replaces active site secrets, previous secrets stay active on error.
+func loadSiteSecrets(path string) error {
+	secrets, err := readSiteSecrets(path)
+	if err != nil {
+		return err
+	}
+
+	siteSecrets.Store(&secrets)
+
+	return nil
+}
+
+// getSiteSecret returns active site secret of domain.
+func getSiteSecret(domain string) (string, bool) {
+	secrets := siteSecrets.Load()
+	if secrets == nil {
+		return "", false
+	}
+
+	secret, ok := (*secrets)[domain]
+
+	return secret, ok
+}
+
+func widgetScriptHandle(w http.ResponseWriter, r *http.Request) {
+	// allow only GET method
+	if r.Method != http.MethodGet {
+		logEvent(slog.LevelDebug, r, http.StatusMethodNotAllowed, messageOnlyGetMethod)
+
+		// return proper HTTP error with headers
+		w.Header().Set("Allow", http.MethodGet)
+		httpError(w, r, messageOnlyGetMethod, http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+
+	if _, err := w.Write([]byte(captchaWidget)); err != nil {
+		logEvent(slog.LevelError, r, http.StatusInternalServerError, messageFailedHTTPResponse)
+	}
+}
+
+func widgetChallengeHandle(w http.ResponseWriter, r *http.Request) {
+	// allow only GET method
+	if r.Method != http.MethodGet {
+		logEvent(slog.LevelDebug, r, http.StatusMethodNotAllowed, messageOnlyGetMethod)
+
+		// return proper HTTP error with headers
+		w.Header().Set("Allow", http.MethodGet)
+		httpError(w, r, messageOnlyGetMethod, http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	// reject banned address
+	if rejectBanned(w, r) {
+		return
+	}
+
+	// widget challenge is always bound to exact host
+	domain := strings.ToLower(r.Header.Get("X-Forwarded-Host"))
+
+	// get random captcha from memory
+	challenge, b64str := captchaDB.Load().GetRandomKeyValue()
+
+	// set how long challenge is valid
+	challengeTTL := getPolicy(r.Header.Get("X-Forwarded-Host")).getChallengeTTL()
+	// generate issue and expire dates for captcha hash
+	issued := time.Now()
+	expires := issued.Add(challengeTTL)
+
+	logEvent(
+		slog.LevelInfo, r, http.StatusOK, messageIssuedChallenge,
+		"domain", domain,
+		"challenge", challenge,
+		"type", "widget",
+		"ttl", challengeTTL.String(),
+	)
+
+	// store captcha hash to db
+	db.Store(challenge,
+		captchaDBRecord{
+			Type:     challengeTypeImage,
+			Solution: challenge,
+
+			Domain:    domain,
+			UserAgent: getRecordUserAgent(r.UserAgent()),
+			Issued:    issued,
+			Expires:   expires,
+
+			Address: getRecordAddress(r.Header.Get("X-Real-IP")),
+		},
+	)
+
+	data := templateData{
+		Base64:       b64str,
+		TextHash:     challenge,
+		ChallengeKey: challengeKey,
+		ResponseKey:  responseKey,
+		Length:       defaultCaptchaLength,
+	}
+
+	if err := writeJSON(w, http.StatusOK, newAPIChallenge(challengeTypeImage, data, expires)); err != nil {
+		logEvent(
+			slog.LevelError, r, http.StatusInternalServerError, messageFailedHTTPResponse,
+			"domain", domain,
+		)
+	}
+}
+
+// rejectWidgetChallenge replies with failed widget validation result.
+func rejectWidgetChallenge(w http.ResponseWriter, r *http.Request, challenge, message string) {
+	logEvent(
+		slog.LevelInfo, r, http.StatusForbidden, message,
+		"challenge", challenge,
+		"type", "widget",
+	)
+
+	if err := writeJSON(w, http.StatusForbidden, apiValidation{Reason: message}); err != nil {
+		logEvent(slog.LevelDebug, r, http.StatusForbidden, messageFailedHTTPResponse)
+	}
+}
+
+func widgetVerifyHandle(w http.ResponseWriter, r *http.Request) {
+	// allow only POST method
+	if r.Method != http.MethodPost {
+		logEvent(slog.LevelDebug, r, http.StatusMethodNotAllowed, messageOnlyPostMethod)
+
+		// return proper HTTP error with headers
+		w.Header().Set("Allow", http.MethodPost)
+		httpError(w, r, messageOnlyPostMethod, http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	// reject banned address
+	if rejectBanned(w, r) {
+		return
+	}
+
+	// widget challenge is always bound to exact host
+	domain := strings.ToLower(r.Header.Get("X-Forwarded-Host"))
+
+	// read validation request from form or JSON body
+	input, err := getValidationRequest(w, r)
+	if err != nil {
+		rejectWidgetChallenge(w, r, "", messageInvalidRequest)
+
+		return
+	}
+
+	challenge := input.Challenge
+
+	// lookup captcha hash in db
+	val, ok := db.Load(challenge)
+	if !ok {
+		rejectWidgetChallenge(w, r, challenge, messageUnknownChallenge)
+
+		return
+	}
+
+	// check captcha hash record
+	record, ok := val.(captchaDBRecord)
+	if !ok || record.Type != challengeTypeImage {
+		rejectWidgetChallenge(w, r, challenge, messageUnknownChallenge)
+
+		return
+	}
+
+	// check that captcha hash is valid for domain
+	if !strings.EqualFold(domain, record.Domain) {
+		rejectWidgetChallenge(w, r, challenge, messageInvalidChallenge)
+
+		return
+	}
+
+	// check captcha hash expiration
+	if record.Expires.Before(time.Now()) {
+		rejectWidgetChallenge(w, r, challenge, messageExpiredChallenge)
+
+		return
+	}
+
+	// reject response that is too fast for a human
+	if solveTime := time.Since(record.Issued); solveTime < cmdMinSolveTime {
+		logBot(
+			http.StatusForbidden, messageTooFastResponse,
+			"domain", record.Domain,
+			"remote_addr", r.Header.Get("X-Real-IP"),
+			"ua", r.UserAgent(),
+			"solve_time", solveTime.String(),
+		)
+
+		db.Delete(challenge)
+
+		countFailure(r.Header.Get("X-Real-IP"), "", messageTooFastResponse)
+
+		rejectWidgetChallenge(w, r, challenge, messageTooFastResponse)
+
+		return
+	}
+
+	// validate user inputed captcha response, case insensitive
+	if getStringHash(strings.ToUpper(input.Response)) != record.Solution {
+		countFailure(r.Header.Get("X-Real-IP"), "", messageInvalidResponse)
+
+		rejectWidgetChallenge(w, r, challenge, messageInvalidResponse)
+
+		return
+	}
+
+	// generate single-use widget token
+	token, err := genUUID()
+	if err != nil {
+		logEvent(
+			slog.LevelError, r, http.StatusInternalServerError, messageFailedEntropy,
+			"domain", domain,
+		)
+
+		// return proper HTTP error
+		httpError(w, r, messageFailedEntropy, http.StatusInternalServerError)
+
+		return
+	}
+
+	// set how long widget token is valid
+	tokenTTL := time.Duration(widgetTokenExpirationSeconds * nanoSecondsInSecond)
+	// generate expire date for widget token
+	issued := time.Now()
+	expires := issued.Add(tokenTTL)
+
+	logEvent(
+		slog.LevelInfo, r, http.StatusOK, messageSolvedChallenge,
+		"domain", domain,
+		"challenge", challenge,
+		"token", token,
+		"ttl", tokenTTL.String(),
+	)
+
+	// challenge is valid, invalidating used challenge hash
+	db.Delete(challenge)
+
+	failures.Reset(r.Header.Get("X-Real-IP"))
+	bans.Forgive(r.Header.Get("X-Real-IP"))
+
+	// store widget token to db
+	db.Store(token,
+		captchaDBRecord{
+			Type: recordTypeWidgetToken,
+
+			Domain:    domain,
+			UserAgent: getRecordUserAgent(r.UserAgent()),
+			Issued:    issued,
+			Expires:   expires,
+
+			Address: getRecordAddress(r.Header.Get("X-Real-IP")),
+		},
+	)
+
+	if err = writeJSON(w, http.StatusOK, apiValidation{
+		Success: true,
+		Token:   token,
+		Expires: &expires,
+	}); err != nil {
+		logEvent(
+			slog.LevelDebug, r, http.StatusOK, messageFailedHTTPResponse,
+			"domain", domain,
+		)
+	}
+}
+
+// writeSiteverify writes site verification response and logs its outcome.
+func writeSiteverify(w http.ResponseWriter, r *http.Request, out siteverifyResponse) {
+	logMessage(
+		slog.LevelInfo, messageSiteverify,
+		"status", http.StatusOK,
+		"remote_addr", r.Header.Get("X-Real-IP"),
+		"domain", out.Hostname,
+		"success", out.Success,
+		"errors", strings.Join(out.ErrorCodes, ","),
+	)
+
+	if err := writeJSON(w, http.StatusOK, out); err != nil {
+		logMessage(
+			slog.LevelDebug, messageFailedHTTPResponse,
+			"status", http.StatusOK,
+			"remote_addr", r.Header.Get("X-Real-IP"),
+		)
+	}
+}
+
+func siteverifyHandle(w http.ResponseWriter, r *http.Request) {
+	// allow only POST method
+	if r.Method != http.MethodPost {
+		logMessage(
+			slog.LevelDebug, messageOnlyPostMethod,
+			"status", http.StatusMethodNotAllowed,
+			"remote_addr", r.Header.Get("X-Real-IP"),
+		)
+
+		// return proper HTTP error with headers
+		w.Header().Set("Allow", http.MethodPost)
+		httpError(w, r, messageOnlyPostMethod, http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	secret := r.PostFormValue("secret")
+	token := r.PostFormValue("response")
+
+	switch {
+	case secret == "":
+		writeSiteverify(w, r, siteverifyResponse{ErrorCodes: []string{"missing-input-secret"}})
+
+		return
+	case token == "":
+		writeSiteverify(w, r, siteverifyResponse{ErrorCodes: []string{"missing-input-response"}})
+
+		return
+	}
+
+	// lookup widget token in db
+	val, ok := db.Load(token)
+	if !ok {
+		writeSiteverify(w, r, siteverifyResponse{ErrorCodes: []string{"timeout-or-duplicate"}})
+
+		return
+	}
+
+	record, ok := val.(captchaDBRecord)
+	if !ok || record.Type != recordTypeWidgetToken {
+		writeSiteverify(w, r, siteverifyResponse{ErrorCodes: []string{"invalid-input-response"}})
+
+		return
+	}
+
+	// check site secret for token domain
+	expected, ok := getSiteSecret(record.Domain)
+	if !ok || subtle.ConstantTimeCompare([]byte(expected), []byte(secret)) != 1 {
+		writeSiteverify(w, r, siteverifyResponse{
+			Hostname:   record.Domain,
+			ErrorCodes: []string{"invalid-input-secret"},
+		})
+
+		return
+	}
+
+	// token is single-use, concurrent verification gets duplicate error
+	if _, ok = db.LoadAndDelete(token); !ok || record.Expires.Before(time.Now()) {
+		writeSiteverify(w, r, siteverifyResponse{
+			Hostname:   record.Domain,
+			ErrorCodes: []string{"timeout-or-duplicate"},
+		})
+
+		return
+	}
+
+	writeSiteverify(w, r, siteverifyResponse{
+		Success:     true,
+		Hostname:    record.Domain,
+		ChallengeTS: &record.Issued,
+	})
+}